@@ -0,0 +1,320 @@
+// Package agent caches groups read from a stocker server and serves them to
+// local processes over a Unix socket, so that each process doesn't need its
+// own SSH connection.
+//
+// The agent speaks the same length prefixed JSON messages as the stocker
+// subsystem, but only supports the env command.
+package agent
+
+import (
+	"context"
+	"github.com/buth/stocker/auth"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long groups are cached unless another TTL is set.
+const DefaultTTL = 5 * time.Minute
+
+// A Source fetches the variables in a group. *client.Client is a Source.
+type Source interface {
+	Env(ctx context.Context, group string) (map[string]string, error)
+}
+
+// cacheEntry is a cached group. Its lock is held while the group is fetched
+// so that concurrent requests for the same group share a single fetch. The
+// timer removes the entry once it expires.
+type cacheEntry struct {
+	variables map[string]string
+	expires   time.Time
+	timer     *time.Timer
+	mu        sync.Mutex
+}
+
+type agent struct {
+	source Source
+	ttl    time.Duration
+
+	// Cached groups.
+	cache   map[string]*cacheEntry
+	cacheMu sync.Mutex
+
+	// Listeners, so that they can be closed by Stop.
+	listeners   []net.Listener
+	listenersMu sync.Mutex
+}
+
+// New creates an agent that fetches groups from source and caches them for
+// ttl.
+func New(source Source, ttl time.Duration) *agent {
+	return &agent{
+		source: source,
+		ttl:    ttl,
+		cache:  make(map[string]*cacheEntry),
+	}
+}
+
+// entry returns the cache entry for a group, creating an empty one if
+// needed. Entries are only kept while a fetch is in progress or once it has
+// succeeded.
+func (a *agent) entry(group string) *cacheEntry {
+
+	// Get the cache lock.
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+
+	e, ok := a.cache[group]
+	if !ok {
+		e = &cacheEntry{}
+		a.cache[group] = e
+	}
+
+	return e
+}
+
+// Env returns the variables in a group, fetching them from the source if
+// they aren't cached or have expired. Failed fetches aren't cached. The map
+// is shared with the cache and must not be modified.
+func (a *agent) Env(ctx context.Context, group string) (map[string]string, error) {
+
+	e := a.entry(group)
+
+	// Get the entry lock.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.variables != nil && time.Now().Before(e.expires) {
+		return e.variables, nil
+	}
+
+	variables, err := a.source.Env(ctx, group)
+	if err != nil {
+
+		// Don't keep an entry, or any expired values, for a group that
+		// couldn't be fetched.
+		e.variables = nil
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+
+		a.remove(group, e)
+		return nil, err
+	}
+
+	e.variables = variables
+	e.expires = time.Now().Add(a.ttl)
+
+	// Forget the values once they expire, even if the group isn't read
+	// again.
+	if e.timer == nil {
+		e.timer = time.AfterFunc(a.ttl, func() { a.expire(group, e) })
+	} else {
+		e.timer.Reset(a.ttl)
+	}
+
+	return variables, nil
+}
+
+// expire removes an entry whose values have expired. The entry's lock is
+// taken before the cache lock, as in Env.
+func (a *agent) expire(group string, e *cacheEntry) {
+
+	// Get the entry lock.
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// The entry may have been fetched again since the timer was set.
+	if time.Now().Before(e.expires) {
+		return
+	}
+
+	e.variables = nil
+	a.remove(group, e)
+}
+
+// remove deletes the entry for a group from the cache, unless it has already
+// been replaced.
+func (a *agent) remove(group string, e *cacheEntry) {
+
+	// Get the cache lock.
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+
+	if a.cache[group] == e {
+		delete(a.cache, group)
+	}
+}
+
+// Flush removes every group from the cache.
+func (a *agent) Flush() {
+
+	// Get the cache lock.
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+
+	a.cache = make(map[string]*cacheEntry)
+}
+
+// Serve accepts connections on the listener until it is closed by Stop, in
+// which case it returns nil.
+func (a *agent) Serve(listener net.Listener) error {
+
+	// Record the listener so that it can be stopped.
+	a.listenersMu.Lock()
+	a.listeners = append(a.listeners, listener)
+	a.listenersMu.Unlock()
+
+	for {
+
+		conn, err := listener.Accept()
+		if err != nil {
+
+			// A listener closed by Stop is not an error.
+			if a.stopped(listener) {
+				return nil
+			}
+
+			return err
+		}
+
+		go a.handleConn(conn)
+	}
+}
+
+// stopped reports whether the listener has been closed by Stop.
+func (a *agent) stopped(listener net.Listener) bool {
+
+	// Get the listeners lock.
+	a.listenersMu.Lock()
+	defer a.listenersMu.Unlock()
+
+	for _, l := range a.listeners {
+		if l == listener {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Stop closes every listener. Connections already accepted are not
+// affected.
+func (a *agent) Stop() error {
+
+	// Swap out the listeners while holding the lock.
+	a.listenersMu.Lock()
+	listeners := a.listeners
+	a.listeners = nil
+	a.listenersMu.Unlock()
+
+	var err error
+	for _, listener := range listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// handleConn answers requests until the client closes the connection.
+func (a *agent) handleConn(conn net.Conn) {
+
+	// Defer the closing of the connection, ignoring any error.
+	defer conn.Close()
+
+	for {
+
+		request := &auth.Request{}
+		if err := auth.ReadMessage(conn, request); err != nil {
+			if err != io.EOF {
+				log.Printf("agent: %s\n", err.Error())
+			}
+
+			return
+		}
+
+		if err := auth.WriteMessage(conn, a.handle(request)); err != nil {
+			log.Printf("agent: %s\n", err.Error())
+			return
+		}
+	}
+}
+
+// handle answers a single request.
+func (a *agent) handle(request *auth.Request) *auth.Response {
+
+	response := &auth.Response{Version: auth.ProtocolVersion}
+
+	if request.Version != auth.ProtocolVersion {
+		response.Error = &auth.ProtocolError{Code: auth.ErrorCodeUnsupportedVersion, Message: "unsupported protocol version"}
+		return response
+	}
+
+	if request.Command != "env" {
+		response.Error = &auth.ProtocolError{Code: auth.ErrorCodeInvalidRequest, Message: "the agent only supports the env command"}
+		return response
+	}
+
+	variables, err := a.Env(context.Background(), request.Group)
+	if err != nil {
+		log.Printf("agent: fetching %s: %s\n", request.Group, err.Error())
+
+		// Pass on errors reported by the server.
+		if protocolErr, ok := err.(*auth.ProtocolError); ok {
+			response.Error = protocolErr
+		} else {
+			response.Error = &auth.ProtocolError{Code: auth.ErrorCodeInternal, Message: err.Error()}
+		}
+
+		return response
+	}
+
+	// Return only the named variables, if any were given.
+	if len(request.Names) == 0 {
+		response.Variables = variables
+		return response
+	}
+
+	response.Variables = make(map[string]string)
+	for _, variable := range request.Names {
+		if value, ok := variables[variable]; ok {
+			response.Variables[variable] = value
+		}
+	}
+
+	return response
+}
+
+// Env asks the agent listening on the Unix socket at path for the variables
+// in a group. Errors reported by the agent or the server are returned as
+// *auth.ProtocolError.
+func Env(path, group string) (map[string]string, error) {
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Defer the closing of the connection, ignoring any error.
+	defer conn.Close()
+
+	request := &auth.Request{Version: auth.ProtocolVersion, Command: "env", Group: group}
+	if err := auth.WriteMessage(conn, request); err != nil {
+		return nil, err
+	}
+
+	response := &auth.Response{}
+	if err := auth.ReadMessage(conn, response); err != nil {
+		return nil, err
+	}
+
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	return response.Variables, nil
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"github.com/buth/stocker/auth"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSource is a source that counts how many times each group is fetched.
+type testSource struct {
+	groups  map[string]map[string]string
+	fetches map[string]int
+	mu      sync.Mutex
+}
+
+func newTestSource() *testSource {
+	return &testSource{
+		groups: map[string]map[string]string{
+			"app": {"A": "1", "B": "2"},
+		},
+		fetches: make(map[string]int),
+	}
+}
+
+func (s *testSource) Env(ctx context.Context, group string) (map[string]string, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetches[group]++
+
+	variables, ok := s.groups[group]
+	if !ok {
+		return nil, &auth.ProtocolError{Code: auth.ErrorCodeUnauthorized, Message: "server: unauthorized"}
+	}
+
+	return variables, nil
+}
+
+func (s *testSource) count(group string) int {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.fetches[group]
+}
+
+func TestAgentCache(t *testing.T) {
+
+	source := newTestSource()
+	a := New(source, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if variables, err := a.Env(context.Background(), "app"); err != nil {
+			t.Fatal(err)
+		} else if variables["A"] != "1" {
+			t.Error(variables)
+		}
+	}
+
+	if n := source.count("app"); n != 1 {
+		t.Errorf("expected 1 fetch but found %d!", n)
+	}
+
+	// Errors shouldn't be cached.
+	for i := 0; i < 2; i++ {
+		if _, err := a.Env(context.Background(), "other"); err == nil {
+			t.Error("expected an error")
+		}
+	}
+
+	if n := source.count("other"); n != 2 {
+		t.Errorf("expected 2 fetches but found %d!", n)
+	}
+
+	// Nor should they leave an entry behind.
+	if n := a.size(); n != 1 {
+		t.Errorf("expected 1 cached group but found %d!", n)
+	}
+
+	a.Flush()
+	a.Env(context.Background(), "app")
+
+	if n := source.count("app"); n != 2 {
+		t.Errorf("expected 2 fetches after flushing but found %d!", n)
+	}
+}
+
+func TestAgentTTL(t *testing.T) {
+
+	source := newTestSource()
+	a := New(source, time.Millisecond)
+
+	a.Env(context.Background(), "app")
+	time.Sleep(5 * time.Millisecond)
+	a.Env(context.Background(), "app")
+
+	if n := source.count("app"); n != 2 {
+		t.Errorf("expected 2 fetches but found %d!", n)
+	}
+
+	// Expired groups should be removed without being read again.
+	time.Sleep(5 * time.Millisecond)
+	if n := a.size(); n != 0 {
+		t.Errorf("expected no cached groups but found %d!", n)
+	}
+}
+
+// size returns the number of cached groups.
+func (a *agent) size() int {
+
+	a.cacheMu.Lock()
+	defer a.cacheMu.Unlock()
+
+	return len(a.cache)
+}
+
+func TestAgentSocket(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := New(newTestSource(), time.Hour)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- a.Serve(listener)
+	}()
+
+	if variables, err := Env(path, "app"); err != nil {
+		t.Error(err)
+	} else if len(variables) != 2 || variables["B"] != "2" {
+		t.Error(variables)
+	}
+
+	// Errors from the server should be passed on.
+	if _, err := Env(path, "other"); err == nil {
+		t.Error("expected an error")
+	} else if protocolErr, ok := err.(*auth.ProtocolError); !ok || protocolErr.Code != auth.ErrorCodeUnauthorized {
+		t.Errorf("expected an unauthorized error but found %v!", err)
+	}
+
+	// Only the env command is supported.
+	response := a.handle(&auth.Request{Version: auth.ProtocolVersion, Command: "export", Group: "app"})
+	if response.Error == nil || response.Error.Code != auth.ErrorCodeInvalidRequest {
+		t.Errorf("expected an invalid request error but found %v!", response.Error)
+	}
+
+	response = a.handle(&auth.Request{Version: auth.ProtocolVersion, Command: "env", Group: "app", Names: []string{"A"}})
+	if response.Error != nil || len(response.Variables) != 1 || response.Variables["A"] != "1" {
+		t.Errorf("unexpected response %+v", response)
+	}
+
+	if err := a.Stop(); err != nil {
+		t.Error(err)
+	}
+
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAgentSourceErrors(t *testing.T) {
+
+	a := New(sourceFunc(func(ctx context.Context, group string) (map[string]string, error) {
+		return nil, errors.New("connection refused")
+	}), time.Hour)
+
+	// Errors that didn't come from the server are reported as internal.
+	response := a.handle(&auth.Request{Version: auth.ProtocolVersion, Command: "env", Group: "app"})
+	if response.Error == nil || response.Error.Code != auth.ErrorCodeInternal {
+		t.Errorf("expected an internal error but found %v!", response.Error)
+	}
+}
+
+// sourceFunc adapts a function to a Source.
+type sourceFunc func(ctx context.Context, group string) (map[string]string, error)
+
+func (f sourceFunc) Env(ctx context.Context, group string) (map[string]string, error) {
+	return f(ctx, group)
+}
@@ -0,0 +1,277 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+)
+
+// An Event records a single command run against the server. Values are never
+// recorded, only the names of the variables involved.
+type Event struct {
+	Time        time.Time `json:"time"`
+	RemoteAddr  string    `json:"remote_addr"`
+	User        string    `json:"user"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Identity    string    `json:"identity,omitempty"`
+	Command     string    `json:"command"`
+	Group       string    `json:"group"`
+	Variables   []string  `json:"variables,omitempty"`
+	Result      string    `json:"result"`
+
+	// KeyChange describes the key added or revoked by a key management
+	// command, by its user and SHA256 fingerprint.
+	KeyChange string `json:"key_change,omitempty"`
+
+	// PreviousHash and Hash are only set when the log is chained.
+	PreviousHash string `json:"previous_hash,omitempty"`
+	Hash         string `json:"hash,omitempty"`
+}
+
+// ResultOK is the result recorded for commands that succeed.
+const ResultOK = "ok"
+
+// A Logger writes events to an audit log.
+type Logger interface {
+	Log(event *Event) error
+}
+
+// NewLogger returns a logger of the given kind. For the "file" kind, location
+// is the path of the log file. If chainKey is set, each event records the
+// hash of the previous one, an HMAC keyed by chainKey, so that changes to the
+// log can be detected by anyone holding the key. If anchor is also set, the
+// hash of each event is recorded in syslog as well, so that removing events
+// from the end of the log can be detected too.
+func NewLogger(kind, location string, chainKey []byte, anchor bool) (Logger, error) {
+
+	chain := chainKey != nil
+	if anchor && !chain {
+		return nil, AuditError{"anchoring requires a chained log"}
+	}
+
+	// Select a writer based on kind.
+	var w io.Writer
+	previousHash := ""
+	switch kind {
+	case "stdout":
+		w = os.Stdout
+	case "syslog":
+		syslogWriter, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "stocker")
+		if err != nil {
+			return nil, err
+		}
+		w = syslogWriter
+	case "file":
+
+		// Resume the chain from the last event in the file.
+		if chain {
+			lastHash, err := lastHashInFile(location)
+			if err != nil {
+				return nil, err
+			}
+			previousHash = lastHash
+		}
+
+		file, err := os.OpenFile(location, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	default:
+
+		// Assuming no logger is implemented for kind.
+		return nil, AuditError{fmt.Sprintf("logger \"%s\" has not been implemented", kind)}
+	}
+
+	l := &logger{w: w, chainKey: chainKey, previousHash: previousHash}
+	if anchor {
+		anchorWriter, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "stocker-audit")
+		if err != nil {
+			return nil, err
+		}
+		l.anchor = anchorWriter
+	}
+
+	return l, nil
+}
+
+// A logger writes events to a writer as JSON, one per line.
+type logger struct {
+	w            io.Writer
+	chainKey     []byte
+	anchor       io.Writer
+	previousHash string
+	mu           sync.Mutex
+}
+
+// Log writes the event, setting its hash fields if the log is chained.
+func (l *logger) Log(event *Event) error {
+
+	// Events must be written one at a time to keep the chain in order.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	chain := l.chainKey != nil
+	if chain {
+		event.PreviousHash = l.previousHash
+		event.Hash = ""
+
+		hash, err := hashEvent(l.chainKey, event)
+		if err != nil {
+			return err
+		}
+		event.Hash = hash
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if chain {
+		l.previousHash = event.Hash
+
+		// Record the new head of the chain outside the log.
+		if l.anchor != nil {
+			if _, err := fmt.Fprintf(l.anchor, "head %s\n", event.Hash); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// hashEvent returns the HMAC-SHA256 of the event's JSON encoding, which
+// includes the previous hash but not its own.
+func hashEvent(key []byte, event *Event) (string, error) {
+
+	unhashed := *event
+	unhashed.Hash = ""
+
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// lastHashInFile returns the hash of the last event in a chained log file, or
+// an empty string if the file doesn't exist or is empty.
+func lastHashInFile(filename string) (string, error) {
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	// Defer the closing of the file, ignoring any error.
+	defer file.Close()
+
+	lastHash := ""
+	reader := bufio.NewReader(file)
+	for {
+
+		line, err := readLine(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return "", err
+		}
+
+		lastHash = event.Hash
+	}
+
+	return lastHash, nil
+}
+
+// readLine returns the next line from r, however long it is. An event can
+// name as many variables as fit in a message, so lines aren't limited to the
+// size of a bufio.Scanner's buffer. It returns io.EOF once every line has
+// been read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+
+	return line, err
+}
+
+// Verify reads a log chained with key and returns an error describing the
+// first event that has been changed, removed or inserted. It returns the
+// number of events verified and the hash of the last one, which can be
+// compared with the head recorded in syslog to detect events removed from
+// the end of the log.
+func Verify(r io.Reader, key []byte) (int, string, error) {
+
+	previousHash := ""
+	n := 0
+
+	reader := bufio.NewReader(r)
+	for {
+
+		line, err := readLine(reader)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return n, previousHash, err
+		}
+
+		n++
+
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return n, previousHash, AuditError{fmt.Sprintf("event %d: %s", n, err)}
+		}
+
+		if event.PreviousHash != previousHash {
+			return n, previousHash, AuditError{fmt.Sprintf("event %d: chain is broken", n)}
+		}
+
+		hash, err := hashEvent(key, &event)
+		if err != nil {
+			return n, previousHash, err
+		}
+
+		if !hmac.Equal([]byte(hash), []byte(event.Hash)) {
+			return n, previousHash, AuditError{fmt.Sprintf("event %d: hash does not match", n)}
+		}
+
+		previousHash = event.Hash
+	}
+
+	return n, previousHash, nil
+}
+
+// AuditError represents a run-time error in an audit method.
+type AuditError struct {
+	Err string
+}
+
+func (e AuditError) Error() string {
+	return fmt.Sprintf("audit: %s", e.Err)
+}
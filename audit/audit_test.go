@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggerChain(t *testing.T) {
+
+	key := []byte("test-key")
+	buffer := bytes.NewBuffer([]byte{})
+	anchor := bytes.NewBuffer([]byte{})
+	l := &logger{w: buffer, chainKey: key, anchor: anchor}
+
+	for _, command := range []string{"env", "export", "unset"} {
+		if err := l.Log(&Event{Command: command, Group: "test", Result: ResultOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	logData := buffer.String()
+
+	n, head, err := Verify(strings.NewReader(logData), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Errorf("expected 3 events but verified %d!", n)
+	}
+
+	// The head of the chain should have been anchored after every event.
+	anchored := strings.Split(strings.TrimSpace(anchor.String()), "\n")
+	if len(anchored) != 3 || anchored[2] != "head "+head {
+		t.Errorf("expected the head %s to be anchored but found %q!", head, anchored)
+	}
+
+	// Changing an event should break the chain.
+	if _, _, err := Verify(strings.NewReader(strings.Replace(logData, `"unset"`, `"env"`, 1)), key); err == nil {
+		t.Error("verified a changed log!")
+	}
+
+	// So should removing one.
+	lines := strings.SplitAfter(logData, "\n")
+	if _, _, err := Verify(strings.NewReader(lines[0]+lines[2]), key); err == nil {
+		t.Error("verified a log with a missing event!")
+	}
+
+	// Without the key, the chain can't be verified, or rebuilt after a change.
+	if _, _, err := Verify(strings.NewReader(logData), []byte("wrong-key")); err == nil {
+		t.Error("verified a log with the wrong key!")
+	}
+}
+
+func TestLoggerFileResume(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "audit.log")
+
+	// Write events with two loggers in turn, as if the server restarted.
+	for i := 0; i < 2; i++ {
+
+		l, err := NewLogger("file", filename, []byte("test-key"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Log(&Event{Command: "env", Group: "test", Variables: []string{"A"}, Result: ResultOK}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	n, _, err := Verify(file, []byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("expected 2 events but verified %d!", n)
+	}
+}
+
+func TestLoggerLongEvent(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "audit.log")
+
+	// An event naming as many variables as fit in a message is far longer
+	// than a default bufio.Scanner line.
+	variables := make([]string, 1<<14)
+	for i := range variables {
+		variables[i] = strings.Repeat("V", 64)
+	}
+
+	// Write a long event followed by a short one, resuming the chain after
+	// the long event as if the server restarted.
+	for _, event := range []*Event{
+		{Command: "export", Group: "test", Variables: variables, Result: ResultOK},
+		{Command: "env", Group: "test", Result: ResultOK},
+	} {
+
+		l, err := NewLogger("file", filename, []byte("test-key"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := l.Log(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	n, _, err := Verify(file, []byte("test-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("expected 2 events but verified %d!", n)
+	}
+}
+
+func TestNewLoggerUnknown(t *testing.T) {
+	if _, err := NewLogger("unknown", "", nil, false); err == nil {
+		t.Error("created a logger of an unknown kind!")
+	}
+}
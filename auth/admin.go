@@ -0,0 +1,297 @@
+package auth
+
+import (
+	"container/list"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"strings"
+)
+
+// revokedSuffix is appended to a user to name the backend key list holding
+// the keys revoked for that user.
+const revokedSuffix = `.revoked`
+
+// AddAdminKey adds a public key that is authorized to connect to the server
+// as an administrator and manage reader and writer keys. Administrators
+// cannot read or write values.
+func (s *server) AddAdminKey(key ssh.PublicKey) {
+
+	// Get the admin keys lock for writing.
+	s.adminKeysMu.Lock()
+	defer s.adminKeysMu.Unlock()
+
+	// Add the key string to the admin keys list.
+	s.adminKeys.PushBack(SerializeKey(key))
+}
+
+// SetAdminKeys replaces every administrator key at once.
+func (s *server) SetAdminKeys(keys []ssh.PublicKey) {
+
+	// Build the new list before taking the lock.
+	adminKeys := newKeyList(keys)
+
+	// Get the admin keys lock for writing.
+	s.adminKeysMu.Lock()
+	defer s.adminKeysMu.Unlock()
+
+	s.adminKeys = adminKeys
+}
+
+func (s *server) matchAdminKey(key ssh.PublicKey) bool {
+
+	// Get the admin keys lock for reading.
+	s.adminKeysMu.RLock()
+	defer s.adminKeysMu.RUnlock()
+
+	// Return the result of the generic match key function.
+	return matchKey(key, s.adminKeys)
+}
+
+// matchAddedKey reports whether an administrator has added the key for the
+// user.
+func (s *server) matchAddedKey(user string, key ssh.PublicKey) bool {
+
+	// Get the managed keys lock for reading.
+	s.managedKeysMu.RLock()
+	defer s.managedKeysMu.RUnlock()
+
+	keys, ok := s.addedKeys[user]
+	return ok && matchKey(key, keys)
+}
+
+// matchRevokedKey reports whether an administrator has revoked the key for
+// the user.
+func (s *server) matchRevokedKey(user string, key ssh.PublicKey) bool {
+
+	// Get the managed keys lock for reading.
+	s.managedKeysMu.RLock()
+	defer s.managedKeysMu.RUnlock()
+
+	keys, ok := s.revokedKeys[user]
+	return ok && matchKey(key, keys)
+}
+
+// keyListIdentitySource returns the source of the names recorded from the
+// named key list.
+func keyListIdentitySource(name string) string {
+	return "keylist:" + name
+}
+
+// authorizedKeyString returns the key in the authorized_keys format without
+// a comment. It is used to store keys in the backend.
+func authorizedKeyString(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// LoadManagedKeys loads the keys added and revoked by administrators from the
+// backend. It should be called before the server starts listening.
+func (s *server) LoadManagedKeys() error {
+
+	for _, user := range []string{ReaderUser, WriterUser} {
+
+		added, err := s.loadKeyList(user)
+		if err != nil {
+			return err
+		}
+
+		revoked, err := s.loadKeyList(user + revokedSuffix)
+		if err != nil {
+			return err
+		}
+
+		// Get the managed keys lock for writing.
+		s.managedKeysMu.Lock()
+		s.addedKeys[user] = added
+		s.revokedKeys[user] = revoked
+		s.managedKeysMu.Unlock()
+	}
+
+	return nil
+}
+
+// loadKeyList reads a key list from the backend, recording the comment of
+// each key as its owner's name.
+func (s *server) loadKeyList(name string) (*list.List, error) {
+
+	keys, err := s.backend.GetKeyList(name)
+	if err != nil {
+		return nil, err
+	}
+
+	l := list.New()
+	authorizedKeys := make([]AuthorizedKey, 0, len(keys))
+	for keyString, comment := range keys {
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyString))
+		if err != nil {
+			return nil, err
+		}
+
+		authorizedKeys = append(authorizedKeys, AuthorizedKey{key, comment})
+		l.PushBack(SerializeKey(key))
+	}
+
+	s.SetIdentities(keyListIdentitySource(name), authorizedKeys)
+	return l, nil
+}
+
+// addManagedKey authorizes a key for the user, clearing any revocation. The
+// change is saved to the backend before it takes effect.
+func (s *server) addManagedKey(user string, key ssh.PublicKey, comment string) error {
+
+	keyString := authorizedKeyString(key)
+	if err := s.backend.AddToKeyList(user, keyString, comment); err != nil {
+		return err
+	}
+
+	if err := s.backend.RemoveFromKeyList(user+revokedSuffix, keyString); err != nil {
+		return err
+	}
+
+	s.setIdentity(keyListIdentitySource(user), key, comment)
+
+	// Get the managed keys lock for writing.
+	s.managedKeysMu.Lock()
+	defer s.managedKeysMu.Unlock()
+
+	removeKey(key, s.revokedKeys[user])
+	if !matchKey(key, s.addedKeys[user]) {
+		s.addedKeys[user].PushBack(SerializeKey(key))
+	}
+
+	return nil
+}
+
+// revokeManagedKey rejects a key for the user, wherever the key came from.
+// The change is saved to the backend before it takes effect.
+func (s *server) revokeManagedKey(user string, key ssh.PublicKey, comment string) error {
+
+	keyString := authorizedKeyString(key)
+	if err := s.backend.AddToKeyList(user+revokedSuffix, keyString, comment); err != nil {
+		return err
+	}
+
+	if err := s.backend.RemoveFromKeyList(user, keyString); err != nil {
+		return err
+	}
+
+	s.setIdentity(keyListIdentitySource(user), key, "")
+
+	// Get the managed keys lock for writing.
+	s.managedKeysMu.Lock()
+	defer s.managedKeysMu.Unlock()
+
+	removeKey(key, s.addedKeys[user])
+	if !matchKey(key, s.revokedKeys[user]) {
+		s.revokedKeys[user].PushBack(SerializeKey(key))
+	}
+
+	return nil
+}
+
+// writeKeyList writes a line for each key in the list in the form:
+//
+//	user status fingerprint authorized-key [comment]
+func (s *server) writeKeyList(w io.Writer, user, status string, keys *list.List) error {
+
+	for e := keys.Front(); e != nil; e = e.Next() {
+
+		key, err := ssh.ParsePublicKey([]byte(e.Value.(string)))
+		if err != nil {
+			return err
+		}
+
+		line := fmt.Sprintf("%s %s %s %s", user, status, FingerprintKey(key), authorizedKeyString(key))
+		if identity := s.identity(key); identity != "" {
+			line += " " + identity
+		}
+
+		fmt.Fprintln(w, line)
+	}
+
+	return nil
+}
+
+// listKeys writes every reader and writer key known to the server. Keys
+// loaded from the server's configuration are listed as "config".
+func (s *server) listKeys(w io.Writer) error {
+
+	// Copy the configured lists while holding their locks.
+	s.readKeysMu.RLock()
+	readKeys := list.New()
+	readKeys.PushBackList(s.readKeys)
+	s.readKeysMu.RUnlock()
+
+	s.writeKeysMu.RLock()
+	writeKeys := list.New()
+	writeKeys.PushBackList(s.writeKeys)
+	s.writeKeysMu.RUnlock()
+
+	if err := s.writeKeyList(w, ReaderUser, "config", readKeys); err != nil {
+		return err
+	}
+
+	if err := s.writeKeyList(w, WriterUser, "config", writeKeys); err != nil {
+		return err
+	}
+
+	// Get the managed keys lock for reading.
+	s.managedKeysMu.RLock()
+	defer s.managedKeysMu.RUnlock()
+
+	for _, user := range []string{ReaderUser, WriterUser} {
+
+		if err := s.writeKeyList(w, user, "added", s.addedKeys[user]); err != nil {
+			return err
+		}
+
+		if err := s.writeKeyList(w, user, "revoked", s.revokedKeys[user]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// manageKeys runs a key management command. The argument is one of:
+//
+//	list
+//	add user authorized-key
+//	revoke user authorized-key
+//
+// where user is the reader or writer user. For add and revoke, it returns a
+// description of the change, such as "add r SHA256:...", for the audit log,
+// even if the change fails.
+func (s *server) manageKeys(stdout io.Writer, argument string) (string, error) {
+
+	components := strings.SplitN(argument, ` `, 3)
+	switch components[0] {
+	case "list":
+		return "", s.listKeys(stdout)
+	case "add", "revoke":
+
+		if len(components) != 3 {
+			return "", ServerError{"keys: missing user or key"}
+		}
+
+		user := components[1]
+		if user != ReaderUser && user != WriterUser {
+			return "", ServerError{fmt.Sprintf("keys: unknown user %q", user)}
+		}
+
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(components[2]))
+		if err != nil {
+			return "", err
+		}
+
+		change := fmt.Sprintf("%s %s %s", components[0], user, FingerprintKey(key))
+		if components[0] == "add" {
+			return change, s.addManagedKey(user, key, comment)
+		}
+
+		return change, s.revokeManagedKey(user, key, comment)
+	}
+
+	return "", ServerError{fmt.Sprintf("keys: unknown command %q", components[0])}
+}
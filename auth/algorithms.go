@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Algorithms lists the SSH key exchange, cipher, MAC and host key algorithms a
+// server will negotiate, in order of preference.
+type Algorithms struct {
+	KeyExchanges, Ciphers, MACs, HostKeys []string
+}
+
+// SupportedAlgorithms are the algorithms implemented by the SSH library that
+// a server may negotiate.
+var SupportedAlgorithms = Algorithms{
+	KeyExchanges: []string{
+		"curve25519-sha256",
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521",
+		"diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha256",
+		"diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1",
+	},
+	Ciphers: []string{
+		"chacha20-poly1305@openssh.com",
+		"aes256-gcm@openssh.com",
+		"aes128-gcm@openssh.com",
+		"aes256-ctr",
+		"aes192-ctr",
+		"aes128-ctr",
+		"arcfour256",
+		"arcfour128",
+	},
+	MACs: []string{
+		"hmac-sha2-256-etm@openssh.com",
+		"hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256",
+		"hmac-sha2-512",
+		"hmac-sha1",
+		"hmac-sha1-96",
+	},
+	HostKeys: []string{
+		"ssh-ed25519",
+		"ecdsa-sha2-nistp256",
+		"ecdsa-sha2-nistp384",
+		"ecdsa-sha2-nistp521",
+		"rsa-sha2-512",
+		"rsa-sha2-256",
+		"ssh-rsa",
+		"ssh-dss",
+	},
+}
+
+// DefaultAlgorithms are the algorithms used unless others are set. They
+// exclude algorithms with known weaknesses, such as RC4, SHA-1 MACs, the 1024
+// bit Diffie-Hellman group and DSA host keys. The chacha20-poly1305 and
+// AES-GCM ciphers carry their own authentication, so the MACs are only used
+// with AES-CTR.
+var DefaultAlgorithms = Algorithms{
+	KeyExchanges: []string{
+		"curve25519-sha256",
+		"curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521",
+		"diffie-hellman-group16-sha512",
+		"diffie-hellman-group14-sha256",
+		"diffie-hellman-group14-sha1",
+	},
+	Ciphers: []string{
+		"chacha20-poly1305@openssh.com",
+		"aes256-gcm@openssh.com",
+		"aes128-gcm@openssh.com",
+		"aes256-ctr",
+		"aes192-ctr",
+		"aes128-ctr",
+	},
+	MACs: []string{
+		"hmac-sha2-256-etm@openssh.com",
+		"hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256",
+		"hmac-sha2-512",
+	},
+	HostKeys: []string{
+		"ssh-ed25519",
+		"ecdsa-sha2-nistp256",
+		"ecdsa-sha2-nistp384",
+		"ecdsa-sha2-nistp521",
+		"rsa-sha2-512",
+		"rsa-sha2-256",
+		"ssh-rsa",
+	},
+}
+
+// FIPSAlgorithms is a strict profile limited to FIPS 140-2 approved
+// algorithms: NIST curves for key exchange, AES, SHA-2 MACs and ECDSA or
+// SHA-2 RSA host key signatures.
+var FIPSAlgorithms = Algorithms{
+	KeyExchanges: []string{
+		"ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521",
+	},
+	Ciphers: []string{
+		"aes256-gcm@openssh.com",
+		"aes128-gcm@openssh.com",
+		"aes256-ctr",
+		"aes192-ctr",
+		"aes128-ctr",
+	},
+	MACs: []string{
+		"hmac-sha2-256-etm@openssh.com",
+		"hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256",
+		"hmac-sha2-512",
+	},
+	HostKeys: []string{
+		"ecdsa-sha2-nistp256",
+		"ecdsa-sha2-nistp384",
+		"ecdsa-sha2-nistp521",
+		"rsa-sha2-512",
+		"rsa-sha2-256",
+	},
+}
+
+// Check returns an error if any of the algorithms are not listed in allowed,
+// or if any kind of algorithm is empty.
+func (a *Algorithms) Check(allowed *Algorithms) error {
+
+	if err := checkAlgorithms("key exchange", a.KeyExchanges, allowed.KeyExchanges); err != nil {
+		return err
+	}
+
+	if err := checkAlgorithms("cipher", a.Ciphers, allowed.Ciphers); err != nil {
+		return err
+	}
+
+	if err := checkAlgorithms("MAC", a.MACs, allowed.MACs); err != nil {
+		return err
+	}
+
+	return checkAlgorithms("host key", a.HostKeys, allowed.HostKeys)
+}
+
+// checkAlgorithms returns an error if names is empty or contains a name that
+// isn't allowed.
+func checkAlgorithms(kind string, names, allowed []string) error {
+
+	if len(names) == 0 {
+		return ServerError{fmt.Sprintf("no %s algorithms", kind)}
+	}
+
+	for _, name := range names {
+
+		found := false
+		for _, allowedName := range allowed {
+			if name == allowedName {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return ServerError{fmt.Sprintf("unsupported %s algorithm %q", kind, name)}
+		}
+	}
+
+	return nil
+}
+
+// hostKeyAlgorithms returns the signature algorithms a host key of the given
+// type can use. RSA keys can sign with SHA-2 as well as SHA-1.
+func hostKeyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{keyType}
+}
+
+// SetAlgorithms sets the algorithms the server will negotiate. It must be
+// called before the server starts listening. The host key is only offered
+// with the listed host key algorithms its type can sign with, so at least one
+// of them must suit the server's host key.
+func (s *server) SetAlgorithms(algorithms *Algorithms) error {
+
+	if err := algorithms.Check(&SupportedAlgorithms); err != nil {
+		return err
+	}
+
+	// Keep the listed host key algorithms the host key can sign with, in the
+	// listed order.
+	hostKeyType := s.hostKey.PublicKey().Type()
+	var offered []string
+	for _, name := range algorithms.HostKeys {
+		if checkAlgorithms("host key", []string{name}, hostKeyAlgorithms(hostKeyType)) == nil {
+			offered = append(offered, name)
+		}
+	}
+
+	if len(offered) == 0 {
+		return ServerError{fmt.Sprintf("the host key is of type %s, which can't sign with any of the host key algorithms", hostKeyType)}
+	}
+
+	signer, ok := s.hostKey.(ssh.AlgorithmSigner)
+	if !ok {
+		return ServerError{"the host key can't be restricted to the host key algorithms"}
+	}
+
+	// Replace the host key with one restricted to the chosen algorithms. The
+	// library replaces the existing key of the same type.
+	hostKey, err := ssh.NewSignerWithAlgorithms(signer, offered)
+	if err != nil {
+		return ServerError{err.Error()}
+	}
+
+	s.serverConfig.AddHostKey(hostKey)
+
+	s.serverConfig.KeyExchanges = algorithms.KeyExchanges
+	s.serverConfig.Ciphers = algorithms.Ciphers
+	s.serverConfig.MACs = algorithms.MACs
+
+	return nil
+}
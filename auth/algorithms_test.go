@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAlgorithmsCheck(t *testing.T) {
+
+	if err := DefaultAlgorithms.Check(&SupportedAlgorithms); err != nil {
+		t.Error(err)
+	}
+
+	if err := FIPSAlgorithms.Check(&DefaultAlgorithms); err != nil {
+		t.Error(err)
+	}
+
+	// The defaults include curve25519, which isn't a FIPS approved curve.
+	if err := DefaultAlgorithms.Check(&FIPSAlgorithms); err == nil {
+		t.Error("default algorithms passed the FIPS profile")
+	}
+
+	unsupported := Algorithms{
+		KeyExchanges: DefaultAlgorithms.KeyExchanges,
+		Ciphers:      []string{"3des-cbc"},
+		MACs:         DefaultAlgorithms.MACs,
+	}
+
+	if err := unsupported.Check(&SupportedAlgorithms); err == nil {
+		t.Error("unsupported cipher passed")
+	}
+
+	// DSA host keys are supported but not allowed by default.
+	dsa := DefaultAlgorithms
+	dsa.HostKeys = []string{"ssh-dss"}
+	if err := dsa.Check(&DefaultAlgorithms); err == nil {
+		t.Error("DSA host key passed the defaults")
+	}
+
+	if err := dsa.Check(&SupportedAlgorithms); err != nil {
+		t.Error(err)
+	}
+
+	empty := Algorithms{
+		KeyExchanges: DefaultAlgorithms.KeyExchanges,
+		Ciphers:      DefaultAlgorithms.Ciphers,
+	}
+
+	if err := empty.Check(&SupportedAlgorithms); err == nil {
+		t.Error("empty MACs passed")
+	}
+}
+
+// algorithmsTestHandshake runs an SSH handshake between the server and a
+// client that only offers the given algorithms. The client has no means of
+// authentication, so a successful key exchange ends in an authentication
+// error.
+func algorithmsTestHandshake(s *server, client *Algorithms) error {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		ssh.NewServerConn(serverConn, s.serverConfig)
+		serverConn.Close()
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer clientConn.Close()
+
+	config := &ssh.ClientConfig{
+		User:              ReaderUser,
+		HostKeyCallback:   ssh.InsecureIgnoreHostKey(),
+		HostKeyAlgorithms: client.HostKeys,
+	}
+	config.KeyExchanges = client.KeyExchanges
+	config.Ciphers = client.Ciphers
+	config.MACs = client.MACs
+
+	_, _, _, err = ssh.NewClientConn(clientConn, "stocker", config)
+	return err
+}
+
+func TestServerSetAlgorithms(t *testing.T) {
+
+	private, err := ssh.ParsePrivateKey(ServerTestPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(nil, nil, private)
+
+	// The defaults negotiate chacha20-poly1305 and the encrypt-then-MAC
+	// algorithms.
+	for _, client := range []Algorithms{
+		{KeyExchanges: []string{"curve25519-sha256"}, Ciphers: []string{"chacha20-poly1305@openssh.com"}, MACs: []string{"hmac-sha2-256-etm@openssh.com"}},
+		{KeyExchanges: []string{"ecdh-sha2-nistp256"}, Ciphers: []string{"aes128-ctr"}, MACs: []string{"hmac-sha2-512-etm@openssh.com"}, HostKeys: []string{"rsa-sha2-512"}},
+	} {
+		if err := algorithmsTestHandshake(s, &client); err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+			t.Errorf("handshake with %v: %v", client, err)
+		}
+	}
+
+	// The host key is only offered with the listed host key algorithms.
+	algorithms := DefaultAlgorithms
+	algorithms.HostKeys = []string{"ecdsa-sha2-nistp256", "rsa-sha2-256"}
+	if err := s.SetAlgorithms(&algorithms); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := algorithmsTestHandshake(s, &Algorithms{HostKeys: []string{"rsa-sha2-256"}}); err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("handshake with rsa-sha2-256: %v", err)
+	}
+
+	for _, hostKey := range []string{"ssh-rsa", "rsa-sha2-512"} {
+		if err := algorithmsTestHandshake(s, &Algorithms{HostKeys: []string{hostKey}}); err == nil || !strings.Contains(err.Error(), "host key") {
+			t.Errorf("handshake with %s: %v", hostKey, err)
+		}
+	}
+
+	// The ciphers are restricted too.
+	algorithms.Ciphers = []string{"aes256-ctr"}
+	if err := s.SetAlgorithms(&algorithms); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := algorithmsTestHandshake(s, &Algorithms{Ciphers: []string{"chacha20-poly1305@openssh.com"}}); err == nil || !strings.Contains(err.Error(), "cipher") {
+		t.Errorf("handshake with chacha20-poly1305: %v", err)
+	}
+
+	// An RSA host key can't sign with any of these algorithms.
+	algorithms.HostKeys = []string{"ecdsa-sha2-nistp256", "ssh-ed25519"}
+	if err := s.SetAlgorithms(&algorithms); err == nil {
+		t.Error("set host key algorithms the host key can't use")
+	}
+}
@@ -2,14 +2,53 @@ package auth
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/ssh"
-	"code.google.com/p/go.crypto/ssh/agent"
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
 	"net"
 	"os"
 )
 
+// A Client is a connection to a stocker server.
 type Client interface {
-	Run(command string) (string, error)
+
+	// Run runs an exec command with the given environment and returns its
+	// output.
+	Run(command string, env map[string]string) (string, error)
+
+	// RunPipelined runs several exec commands in a single session, sending
+	// them all before reading any output, and returns the output of each.
+	// The server must support KeepSessionVariable.
+	RunPipelined(commands []Command) ([]string, error)
+
+	// Do sends a single request using the stocker subsystem.
+	Do(request *Request) (*Response, error)
+
+	// OpenSession starts the stocker subsystem in a new session that can be
+	// used for any number of requests.
+	OpenSession() (Session, error)
+
+	Close() error
+}
+
+// A Command is an exec command along with the environment variables to set
+// before it is run.
+type Command struct {
+	Command string
+	Env     map[string]string
+}
+
+// ErrSubsystemRefused is returned by OpenSession and Do when the server
+// refuses the stocker subsystem, as servers that predate it do.
+var ErrSubsystemRefused = ClientError{"the server does not support the stocker subsystem"}
+
+// A Session is a stocker subsystem session. Requests are answered in order,
+// so a session must not be used by more than one goroutine at a time.
+type Session interface {
+	Do(request *Request) (*Response, error)
 	Close() error
 }
 
@@ -17,19 +56,77 @@ type client struct {
 	client *ssh.Client
 }
 
-func NewClient(user, address string, privateKey []byte) (*client, error) {
-	c := &client{}
+type session struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+}
+
+// NewClient connects to the server at address as the given user. The address
+// may list several servers in the form accepted by ResolveAddresses, which
+// are tried as described by DefaultFailover. If privateKey is nil, keys are
+// taken from ssh-agent. Encrypted keys need a ClientKey with a passphrase, as
+// accepted by ClientConfig. The server's host key is verified using
+// hostKeyCallback; if it is nil, every host key is rejected.
+func NewClient(user, address string, privateKey []byte, hostKeyCallback HostKeyCallback) (Client, error) {
+
+	config, err := ClientConfig(user, &ClientKey{PrivateKey: privateKey}, hostKeyCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	return DialClient(context.Background(), address, config, &DefaultFailover)
+}
+
+// NewClientConn establishes a client connection over an existing network
+// connection, using a configuration built by ClientConfig.
+func NewClientConn(conn net.Conn, address string, config *ssh.ClientConfig) (Client, error) {
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &client{client: ssh.NewClient(sshConn, chans, reqs)}, nil
+}
+
+// A ClientKey describes the key a client authenticates with.
+type ClientKey struct {
+
+	// PrivateKey is a private key in the OpenSSH format or PEM encoded. If it
+	// is nil, keys are taken from ssh-agent.
+	PrivateKey []byte
+
+	// Passphrase is called to get the passphrase of an encrypted private
+	// key.
+	Passphrase PassphraseFunc
+
+	// AgentKey selects the ssh-agent keys with this SHA256 fingerprint or
+	// comment. If it is empty, every key in ssh-agent is offered.
+	AgentKey string
+}
+
+// ClientConfig builds the SSH configuration used to connect as the given
+// user. The server's host key is verified using hostKeyCallback; if it is
+// nil, every host key is rejected.
+func ClientConfig(user string, key *ClientKey, hostKeyCallback HostKeyCallback) (*ssh.ClientConfig, error) {
+
+	// Fail closed if no host key verification has been configured.
+	if hostKeyCallback == nil {
+		hostKeyCallback = rejectHostKey
+	}
 
 	config := &ssh.ClientConfig{
-		User: user,
+		User:            user,
+		HostKeyCallback: ssh.HostKeyCallback(hostKeyCallback),
 	}
 
 	// Check if we've been given a byte slice from which to parse a key.
-	if privateKey != nil {
+	if key.PrivateKey != nil {
 
-		privateKeyParsed, err := ssh.ParsePrivateKey(privateKey)
+		privateKeyParsed, err := ParsePrivateKey(key.PrivateKey, key.Passphrase)
 		if err != nil {
-			return c, err
+			return nil, err
 		}
 
 		config.Auth = []ssh.AuthMethod{
@@ -37,17 +134,9 @@ func NewClient(user, address string, privateKey []byte) (*client, error) {
 		}
 	} else {
 
-		sshAuthSock := os.Getenv(`SSH_AUTH_SOCK`)
-
-		socket, err := net.Dial("unix", sshAuthSock)
-		if err != nil {
-			return c, err
-		}
-
-		sshAgent := agent.NewClient(socket)
-		signers, err := sshAgent.Signers()
+		signers, err := agentSigners(key.AgentKey)
 		if err != nil {
-			return c, err
+			return nil, err
 		}
 
 		config.Auth = []ssh.AuthMethod{
@@ -55,14 +144,67 @@ func NewClient(user, address string, privateKey []byte) (*client, error) {
 		}
 	}
 
-	client, err := ssh.Dial("tcp", address, config)
+	return config, nil
+}
+
+// agentSigners returns the ssh-agent keys with the given SHA256 fingerprint
+// or comment, or every key if agentKey is empty.
+func agentSigners(agentKey string) ([]ssh.Signer, error) {
+
+	sshAuthSock := os.Getenv(`SSH_AUTH_SOCK`)
+	if sshAuthSock == "" {
+		return nil, ClientError{"no private key was given and ssh-agent is not available (SSH_AUTH_SOCK is not set)"}
+	}
+
+	// The socket is left open so that the agent can sign during the
+	// handshake, unless no signers are returned.
+	socket, err := net.Dial("unix", sshAuthSock)
+	if err != nil {
+		return nil, ClientError{fmt.Sprintf("could not connect to ssh-agent: %s", err)}
+	}
+
+	sshAgent := agent.NewClient(socket)
+	signers, err := sshAgent.Signers()
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	if len(signers) == 0 {
+		socket.Close()
+		return nil, ClientError{"ssh-agent has no keys"}
+	}
+
+	if agentKey == "" {
+		return signers, nil
+	}
+
+	// Look up the comment of each key, which the signers don't have.
+	keys, err := sshAgent.List()
 	if err != nil {
-		return c, err
+		socket.Close()
+		return nil, err
 	}
 
-	c.client = client
+	comments := make(map[string]string)
+	for _, key := range keys {
+		comments[string(key.Blob)] = key.Comment
+	}
 
-	return c, nil
+	var selected []ssh.Signer
+	for _, signer := range signers {
+		publicKey := signer.PublicKey()
+		if FingerprintKey(publicKey) == agentKey || comments[string(publicKey.Marshal())] == agentKey {
+			selected = append(selected, signer)
+		}
+	}
+
+	if len(selected) == 0 {
+		socket.Close()
+		return nil, ClientError{fmt.Sprintf("ssh-agent has no key with the fingerprint or comment %s", agentKey)}
+	}
+
+	return selected, nil
 }
 
 func (c *client) Run(command string, env map[string]string) (string, error) {
@@ -78,8 +220,9 @@ func (c *client) Run(command string, env map[string]string) (string, error) {
 
 	// Once a Session is created, you can execute a single command on
 	// the remote side using the Run method.
-	var buf bytes.Buffer
+	var buf, stderr bytes.Buffer
 	session.Stdout = &buf
+	session.Stderr = &stderr
 
 	// Set the environment.
 	for variable, value := range env {
@@ -89,6 +232,14 @@ func (c *client) Run(command string, env map[string]string) (string, error) {
 	}
 
 	if err := session.Run(command); err != nil {
+
+		// The server reports why a command failed on stderr.
+		if _, ok := err.(*ssh.ExitError); ok {
+			if protocolErr := parseProtocolError(stderr.Bytes()); protocolErr != nil {
+				return "", protocolErr
+			}
+		}
+
 		return "", err
 	}
 
@@ -96,6 +247,171 @@ func (c *client) Run(command string, env map[string]string) (string, error) {
 	return buf.String(), nil
 }
 
+// RunPipelined runs the commands in order in a single session, without
+// waiting for each to finish before sending the next. Variables set for one
+// command remain set for those after it. If a command fails, its error is
+// returned along with the output of the commands before it; the commands
+// after it have already been sent and are still run. Servers that don't
+// support KeepSessionVariable run only the first command and then close the
+// session, so the second result fails to be read.
+func (c *client) RunPipelined(commands []Command) ([]string, error) {
+
+	// Create a new session in which to run the commands.
+	session, err := c.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	// Defer the sessions closing, ignoring any error.
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	// Ask the server to keep the session open after each command.
+	if _, err := session.SendRequest("env", false, PackMessage(KeepSessionVariable, "1")); err != nil {
+		return nil, err
+	}
+
+	// Send every command without waiting for a reply.
+	for _, command := range commands {
+
+		for variable, value := range command.Env {
+			if _, err := session.SendRequest("env", false, PackMessage(variable, value)); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err := session.SendRequest("exec", false, PackMessage(command.Command)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read the result of each command in turn.
+	outputs := make([]string, 0, len(commands))
+	for _ = range commands {
+
+		response := &Response{}
+		if err := ReadMessage(stdout, response); err != nil {
+			return outputs, err
+		}
+
+		if response.Error != nil {
+			return outputs, response.Error
+		}
+
+		outputs = append(outputs, response.Output)
+	}
+
+	return outputs, nil
+}
+
+// Do sends a request to the server using the stocker subsystem and returns
+// the response. Errors reported by the server are returned as
+// *ProtocolError.
+func (c *client) Do(request *Request) (*Response, error) {
+
+	// Start a session just for this request.
+	session, err := c.OpenSession()
+	if err != nil {
+		return nil, err
+	}
+
+	// Defer the sessions closing, ignoring any error.
+	defer session.Close()
+
+	return session.Do(request)
+}
+
+// OpenSession starts the stocker subsystem in a new session.
+func (c *client) OpenSession() (Session, error) {
+
+	// Create a new session in which to start the subsystem.
+	sshSession, err := c.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	stdin, err := sshSession.StdinPipe()
+	if err != nil {
+		sshSession.Close()
+		return nil, err
+	}
+
+	stdout, err := sshSession.StdoutPipe()
+	if err != nil {
+		sshSession.Close()
+		return nil, err
+	}
+
+	// Send the request directly, rather than with RequestSubsystem, so that
+	// a refusal can be told apart from a broken connection.
+	ok, err := sshSession.SendRequest("subsystem", true, PackMessage(SubsystemName))
+	if err == nil && !ok {
+		err = ErrSubsystemRefused
+	}
+
+	if err != nil {
+		sshSession.Close()
+		return nil, err
+	}
+
+	return &session{session: sshSession, stdin: stdin, stdout: stdout}, nil
+}
+
+// Do sends a request and waits for its response. Errors reported by the
+// server are returned as *ProtocolError.
+func (s *session) Do(request *Request) (*Response, error) {
+
+	// Requests are always sent using the current version.
+	request.Version = ProtocolVersion
+	if err := WriteMessage(s.stdin, request); err != nil {
+		return nil, err
+	}
+
+	response := &Response{}
+	if err := ReadMessage(s.stdout, response); err != nil {
+		return nil, err
+	}
+
+	if response.Error != nil {
+		return nil, response.Error
+	}
+
+	return response, nil
+}
+
+// Close ends the session, signalling that there are no more requests.
+func (s *session) Close() error {
+
+	// Ignore any error closing stdin; the session is closed either way.
+	s.stdin.Close()
+
+	return s.session.Close()
+}
+
+// parseProtocolError parses an error written to stderr by the server. It
+// returns nil if the data isn't a valid error.
+func parseProtocolError(data []byte) *ProtocolError {
+
+	protocolErr := &ProtocolError{}
+	if err := json.Unmarshal(bytes.TrimSpace(data), protocolErr); err != nil || protocolErr.Code == "" {
+		return nil
+	}
+
+	return protocolErr
+}
+
 func (c *client) Close() error {
 	return c.client.Close()
 }
+
+type ClientError struct {
+	Err string
+}
+
+func (e ClientError) Error() string {
+	return fmt.Sprintf("client: %s", e.Err)
+}
@@ -2,7 +2,14 @@ package auth
 
 import (
 	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 var ClientTestPrivateKeys = [][]byte{
@@ -230,7 +237,7 @@ func TestClient(t *testing.T) {
 		fmt.Println("key")
 
 		// Ensure the reader connection can only read.
-		rclient, err := NewClient(ReaderUser, `:2022`, privateKey)
+		rclient, err := NewClient(ReaderUser, `:2022`, privateKey, clientTestHostKeyCallback())
 		if err != nil {
 			t.Error(err)
 		} else {
@@ -251,7 +258,7 @@ func TestClient(t *testing.T) {
 		rclient.Close()
 
 		// Ensure the writer connection can read and write.
-		wclient, err := NewClient(WriterUser, `:2022`, privateKey)
+		wclient, err := NewClient(WriterUser, `:2022`, privateKey, clientTestHostKeyCallback())
 		if err != nil {
 			t.Error(err)
 		} else {
@@ -285,6 +292,16 @@ func TestClient(t *testing.T) {
 	}
 }
 
+// clientTestHostKeyCallback returns a callback that only accepts the test
+// server's host key.
+func clientTestHostKeyCallback() HostKeyCallback {
+
+	// The test server key is known to be valid.
+	private, _ := ssh.ParsePrivateKey(ServerTestPrivateKey)
+
+	return PinnedHostKey(FingerprintKey(private.PublicKey()))
+}
+
 func TestClientSetEnv(t *testing.T) {
 
 	server, err := newTestServer()
@@ -294,7 +311,7 @@ func TestClientSetEnv(t *testing.T) {
 
 	go server.ListenAndServe(`:2022`)
 
-	client, err := NewClient(WriterUser, `:2022`, ClientTestPrivateKeys[0])
+	client, err := NewClient(WriterUser, `:2022`, ClientTestPrivateKeys[0], clientTestHostKeyCallback())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -325,6 +342,61 @@ func TestClientSetEnv(t *testing.T) {
 	}
 }
 
+func TestClientRunPipelined(t *testing.T) {
+
+	server, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.ListenAndServe(`:2022`)
+
+	client, err := NewClient(WriterUser, `:2022`, ClientTestPrivateKeys[0], clientTestHostKeyCallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs, err := client.RunPipelined([]Command{
+		{Command: "export A", Env: map[string]string{"A": "1"}},
+		{Command: "export B=2"},
+		{Command: "env"},
+		{Command: "unset A"},
+		{Command: "unset B"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(outputs) != 5 || outputs[2] != "A=1\nB=2\n" {
+		t.Errorf("unexpected outputs %q", outputs)
+	}
+
+	// Close the writer client.
+	client.Close()
+
+	client, err = NewClient(ReaderUser, `:2022`, ClientTestPrivateKeys[0], clientTestHostKeyCallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed command should stop the results, keeping those before it.
+	outputs, err = client.RunPipelined([]Command{{Command: "env"}, {Command: "export A=1"}, {Command: "env"}})
+	if protocolErr, ok := err.(*ProtocolError); !ok || protocolErr.Code != ErrorCodeUnauthorized {
+		t.Errorf("expected an unauthorized error but found %v!", err)
+	}
+
+	if len(outputs) != 1 {
+		t.Errorf("unexpected outputs %q", outputs)
+	}
+
+	// Close the reader client.
+	client.Close()
+
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestClientUnauthorized(t *testing.T) {
 
 	server, err := newTestServer()
@@ -334,7 +406,7 @@ func TestClientUnauthorized(t *testing.T) {
 
 	go server.ListenAndServe(`:2022`)
 
-	if _, err := NewClient(WriterUser, `:2022`, ClientTestUnauthorizedKey); err == nil {
+	if _, err := NewClient(WriterUser, `:2022`, ClientTestUnauthorizedKey, clientTestHostKeyCallback()); err == nil {
 		t.Error("unauthorized client allowed to connect")
 	}
 
@@ -342,3 +414,176 @@ func TestClientUnauthorized(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestClientWrongHostKey(t *testing.T) {
+
+	server, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.ListenAndServe(`:2022`)
+
+	if _, err := NewClient(WriterUser, `:2022`, ClientTestPrivateKeys[0], PinnedHostKey("SHA256:AAAA")); err == nil {
+		t.Error("client connected to a server with the wrong host key")
+	}
+
+	if _, err := NewClient(WriterUser, `:2022`, ClientTestPrivateKeys[0], nil); err == nil {
+		t.Error("client connected without host key verification")
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientSubsystem(t *testing.T) {
+
+	server, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.ListenAndServe(`:2022`)
+
+	client, err := NewClient(WriterUser, `:2022`, ClientTestPrivateKeys[0], clientTestHostKeyCallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Do(&Request{Command: "export", Group: "subsystem", Variables: map[string]string{"A": "1", "B": "2"}}); err != nil {
+		t.Error(err)
+	}
+
+	if response, err := client.Do(&Request{Command: "env", Group: "subsystem"}); err != nil {
+		t.Error(err)
+	} else if response.Variables["A"] != "1" || response.Variables["B"] != "2" {
+		t.Error(response.Variables)
+	}
+
+	if response, err := client.Do(&Request{Command: "env", Group: "subsystem", Names: []string{"B", "C"}}); err != nil {
+		t.Error(err)
+	} else if len(response.Variables) != 1 || response.Variables["B"] != "2" {
+		t.Error(response.Variables)
+	}
+
+	if response, err := client.Do(&Request{Command: "groups"}); err != nil {
+		t.Error(err)
+	} else if len(response.Groups) == 0 {
+		t.Error("no groups listed")
+	}
+
+	if _, err := client.Do(&Request{Command: "unknown"}); err == nil {
+		t.Error("unknown command succeeded")
+	} else if protocolErr, ok := err.(*ProtocolError); !ok || protocolErr.Code != ErrorCodeInvalidRequest {
+		t.Errorf("expected an invalid request error but found %v!", err)
+	}
+
+	if _, err := client.Do(&Request{Command: "shred", Group: "subsystem"}); err != nil {
+		t.Error(err)
+	}
+
+	// Close the writer client.
+	client.Close()
+
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+
+	server, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.ListenAndServe(`:2022`)
+
+	client, err := NewClient(ReaderUser, `:2022`, ClientTestPrivateKeys[0], clientTestHostKeyCallback())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The reason for the failure should be reported to the client.
+	if _, err := client.Run("export A=1", nil); err == nil {
+		t.Error("write command allowed for reader")
+	} else if protocolErr, ok := err.(*ProtocolError); !ok || protocolErr.Code != ErrorCodeUnauthorized {
+		t.Errorf("expected an unauthorized error but found %v!", err)
+	}
+
+	// Close the reader client.
+	client.Close()
+
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConfigNoAgent(t *testing.T) {
+
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	// Without a private key or an agent there is nothing to authenticate
+	// with, which should be reported rather than dialing an empty path.
+	if _, err := ClientConfig(ReaderUser, &ClientKey{}, nil); err == nil {
+		t.Error("expected an error")
+	} else if _, ok := err.(ClientError); !ok {
+		t.Errorf("expected a ClientError but found %v", err)
+	}
+}
+
+func TestClientConfigAgentClosed(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Serve a keyring holding one of the test keys as the ssh-agent.
+	keyring := agent.NewKeyring()
+	privateKey, err := ssh.ParseRawPrivateKey(ClientTestPrivateKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keyring.Add(agent.AddedKey{PrivateKey: privateKey, Comment: "key1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sshAuthSock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sshAuthSock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		agent.ServeAgent(keyring, conn)
+		close(closed)
+	}()
+
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Setenv("SSH_AUTH_SOCK", sshAuthSock)
+
+	// No key in the agent matches, so the connection to it should be closed.
+	if _, err := ClientConfig(ReaderUser, &ClientKey{AgentKey: "key2"}, nil); err == nil {
+		t.Fatal("expected an error")
+	} else if _, ok := err.(ClientError); !ok {
+		t.Errorf("expected a ClientError but found %v", err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("the connection to ssh-agent was left open")
+	}
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvPrefix marks an address as a DNS SRV name to be looked up.
+const srvPrefix = `srv:`
+
+// Failover controls how a client works through a list of server addresses.
+type Failover struct {
+
+	// Randomize tries the addresses in a random order on each pass, rather
+	// than the order given, so that clients spread out across servers. The
+	// targets of an SRV name stay together and in priority order, since the
+	// resolver already spreads clients out by weight within each priority.
+	Randomize bool
+
+	// AttemptTimeout limits each attempt to connect to a single address,
+	// including the SSH handshake. Zero means attempts are only limited by
+	// the context.
+	AttemptTimeout time.Duration
+
+	// Retries is the number of further passes made over the addresses after
+	// every one has failed.
+	Retries int
+
+	// Backoff is the wait before the first retry. It doubles on each retry,
+	// up to MaxBackoff.
+	Backoff, MaxBackoff time.Duration
+
+	// rand shuffles the addresses when Randomize is set. It is seeded on
+	// first use, since the global source is not seeded.
+	rand   *rand.Rand
+	randMu sync.Mutex
+}
+
+// DefaultFailover is the failover used by NewClient, and by DialClient if no
+// failover is given.
+var DefaultFailover = Failover{
+	AttemptTimeout: 10 * time.Second,
+	Retries:        2,
+	Backoff:        500 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+}
+
+// ResolveAddresses expands a comma separated list of addresses. Entries
+// prefixed with "srv:", such as "srv:_stocker._tcp.example.com", are looked
+// up in DNS and replaced by their targets in priority and weight order. All
+// other entries are in the form accepted by ParseAddress.
+func ResolveAddresses(ctx context.Context, addresses string) ([]string, error) {
+
+	groups, err := resolveAddressGroups(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved []string
+	for _, group := range groups {
+		resolved = append(resolved, group...)
+	}
+
+	return resolved, nil
+}
+
+// resolveAddressGroups expands a comma separated list of addresses as
+// ResolveAddresses does, keeping the targets of each SRV name together in a
+// group. Every other address is a group of its own.
+func resolveAddressGroups(ctx context.Context, addresses string) ([][]string, error) {
+
+	var groups [][]string
+	for _, address := range strings.Split(addresses, ",") {
+
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(address, srvPrefix) {
+			groups = append(groups, []string{address})
+			continue
+		}
+
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", strings.TrimPrefix(address, srvPrefix))
+		if err != nil {
+			return nil, err
+		}
+
+		group := make([]string, 0, len(records))
+		for _, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			group = append(group, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+		}
+
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	if len(groups) == 0 {
+		return nil, ClientError{"no server addresses given"}
+	}
+
+	return groups, nil
+}
+
+// DialClient connects to the first of addresses, in the form accepted by
+// ResolveAddresses, that completes an SSH handshake, using a configuration
+// built by ClientConfig. If every address fails, it waits and tries them all
+// again as described by failover, returning the last error once the retries
+// run out. If failover is nil, DefaultFailover is used.
+//
+// Only failures to connect, such as refused connections, timeouts and
+// connections closed during the handshake, move on to the next address. If
+// a server's host key is rejected or it refuses to authenticate the client,
+// trying other servers with the same configuration is pointless or unsafe,
+// so the error is returned at once.
+func DialClient(ctx context.Context, addresses string, config *ssh.ClientConfig, failover *Failover) (Client, error) {
+
+	if failover == nil {
+		failover = &DefaultFailover
+	}
+
+	groups, err := resolveAddressGroups(ctx, addresses)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff := failover.Backoff
+	for retry := 0; ; retry++ {
+
+		for _, address := range failover.order(groups) {
+
+			c, fatal, dialErr := dialClient(ctx, address, config, failover.AttemptTimeout)
+			if dialErr == nil {
+				return c, nil
+			}
+
+			// Don't try other addresses once the caller has given up.
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			if fatal {
+				return nil, dialErr
+			}
+
+			err = dialErr
+		}
+
+		if retry >= failover.Retries {
+			return nil, err
+		}
+
+		// Wait before trying again, unless the caller gives up first.
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+
+		backoff *= 2
+		if failover.MaxBackoff > 0 && backoff > failover.MaxBackoff {
+			backoff = failover.MaxBackoff
+		}
+	}
+}
+
+// order returns the addresses in the groups in the order they should be
+// tried. When randomizing, the groups are shuffled but the addresses within
+// each group keep their order.
+func (f *Failover) order(groups [][]string) []string {
+
+	var addresses []string
+	if !f.Randomize {
+		for _, group := range groups {
+			addresses = append(addresses, group...)
+		}
+
+		return addresses
+	}
+
+	f.randMu.Lock()
+	if f.rand == nil {
+		f.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	perm := f.rand.Perm(len(groups))
+	f.randMu.Unlock()
+
+	for _, i := range perm {
+		addresses = append(addresses, groups[i]...)
+	}
+
+	return addresses
+}
+
+// dialClient connects to a single address, giving up after timeout if it is
+// not zero. It reports whether an error is fatal, meaning that the server
+// was reached but its host key was rejected or it refused to authenticate
+// the client.
+func dialClient(ctx context.Context, address string, config *ssh.ClientConfig, timeout time.Duration) (Client, bool, error) {
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	network, networkAddress := ParseAddress(address)
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, networkAddress)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Note whether the host key was checked and rejected. The SSH library
+	// only reports handshake failures as text.
+	hostKeyChecked := false
+	var hostKeyErr error
+	checkedConfig := *config
+	checkedConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostKeyChecked = true
+		if config.HostKeyCallback != nil {
+			hostKeyErr = config.HostKeyCallback(hostname, remote, key)
+		}
+
+		return hostKeyErr
+	}
+
+	// The SSH handshake doesn't take a context, so abandon it by closing the
+	// network connection if the context is done first.
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	c, err := NewClientConn(conn, address, &checkedConfig)
+	close(handshakeDone)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, false, ctx.Err()
+		}
+
+		if hostKeyErr != nil {
+			return nil, true, hostKeyErr
+		}
+
+		// Once the host key has been accepted, the connection works and
+		// only authentication is left to fail.
+		fatal := hostKeyChecked && strings.Contains(err.Error(), "unable to authenticate")
+		return nil, fatal, err
+	}
+
+	return c, false, nil
+}
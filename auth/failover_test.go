@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveAddresses(t *testing.T) {
+
+	addresses, err := ResolveAddresses(context.Background(), "a:2022, b:2022,,unix:/run/stocker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(addresses, ",") != "a:2022,b:2022,unix:/run/stocker.sock" {
+		t.Errorf("unexpected addresses %v", addresses)
+	}
+
+	if _, err := ResolveAddresses(context.Background(), " , "); err == nil {
+		t.Error("expected an error for an empty list")
+	}
+}
+
+func TestFailoverOrder(t *testing.T) {
+
+	groups := [][]string{{"a"}, {"b"}, {"c1", "c2", "c3"}, {"d"}}
+
+	ordered := (&Failover{}).order(groups)
+	if strings.Join(ordered, ",") != "a,b,c1,c2,c3,d" {
+		t.Errorf("unexpected order %v", ordered)
+	}
+
+	failover := &Failover{Randomize: true}
+	orders := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+
+		shuffled := failover.order(groups)
+		orders[strings.Join(shuffled, ",")] = true
+
+		// The targets of an SRV name should stay together and in order.
+		joined := strings.Join(shuffled, ",")
+		if !strings.Contains(joined, "c1,c2,c3") {
+			t.Errorf("shuffling split up a group in %v", shuffled)
+		}
+
+		sort.Strings(shuffled)
+		if strings.Join(shuffled, ",") != "a,b,c1,c2,c3,d" {
+			t.Errorf("shuffling changed the addresses to %v", shuffled)
+		}
+	}
+
+	// The same failover should shuffle the groups differently over time.
+	if len(orders) < 2 {
+		t.Errorf("shuffling always gave the order %v", orders)
+	}
+
+	// The original groups shouldn't be modified.
+	if strings.Join(groups[2], ",") != "c1,c2,c3" {
+		t.Errorf("shuffling modified the groups to %v", groups)
+	}
+}
+
+// refusedAddress returns the address of a port that nothing is listening on.
+func refusedAddress(t *testing.T) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+	listener.Close()
+
+	return address
+}
+
+func TestDialClientRetries(t *testing.T) {
+
+	addresses := refusedAddress(t) + "," + refusedAddress(t)
+	failover := &Failover{
+		AttemptTimeout: time.Second,
+		Retries:        2,
+		Backoff:        10 * time.Millisecond,
+		MaxBackoff:     15 * time.Millisecond,
+	}
+
+	// Two retries should back off for 10ms and then 15ms.
+	start := time.Now()
+	if _, err := DialClient(context.Background(), addresses, &ssh.ClientConfig{}, failover); err == nil {
+		t.Fatal("connected to a refused address")
+	}
+
+	if elapsed := time.Since(start); elapsed < 25*time.Millisecond {
+		t.Errorf("expected to back off for at least 25ms but took %s", elapsed)
+	}
+
+	// Giving up should stop the retries.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	failover.Retries = 1000
+	if _, err := DialClient(ctx, addresses, &ssh.ClientConfig{}, failover); err != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded but found %v", err)
+	}
+}
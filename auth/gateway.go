@@ -0,0 +1,390 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GatewayWriterUnit is the organizational unit that marks a client
+// certificate as belonging to a writer. Other certificates are readers.
+const GatewayWriterUnit = `writer`
+
+// gatewayPrefix is the path prefix of every gateway endpoint.
+const gatewayPrefix = `/v1/`
+
+// GatewayConfig configures the HTTPS gateway. At least one of ClientCAs and
+// TokenSecret must be set.
+type GatewayConfig struct {
+
+	// Certificate is the gateway's TLS certificate.
+	Certificate tls.Certificate
+
+	// ClientCAs verifies client certificates. If it is nil, client
+	// certificates are not requested.
+	ClientCAs *x509.CertPool
+
+	// TokenSecret verifies tokens created by SignToken. If it is nil,
+	// tokens are not accepted.
+	TokenSecret []byte
+}
+
+// A gateway serves the same operations as the SSH server as a JSON API over
+// HTTPS.
+type gateway struct {
+	server      *server
+	tokenSecret []byte
+}
+
+// gatewayCaller is the caller for an HTTPS request.
+type gatewayCaller struct {
+	user       string
+	remoteAddr gatewayAddr
+	perms      *ssh.Permissions
+}
+
+func (c *gatewayCaller) User() string {
+	return c.user
+}
+
+func (c *gatewayCaller) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *gatewayCaller) permissions() *ssh.Permissions {
+	return c.perms
+}
+
+// gatewayAddr is the remote address of an HTTPS request.
+type gatewayAddr string
+
+func (a gatewayAddr) Network() string {
+	return "tcp"
+}
+
+func (a gatewayAddr) String() string {
+	return string(a)
+}
+
+// ListenAndServeHTTPS starts the HTTPS gateway listening on the given
+// address. Like ListenAndServe, it returns nil once stopped by Stop.
+func (s *server) ListenAndServeHTTPS(address string, config *GatewayConfig) error {
+
+	// Start listening.
+	listener, err := Listen(address, DefaultSocketMode)
+	if err != nil {
+		return err
+	}
+
+	return s.ServeHTTPS(listener, config)
+}
+
+// ServeHTTPS serves the HTTPS gateway on the listener.
+func (s *server) ServeHTTPS(listener net.Listener, config *GatewayConfig) error {
+
+	if config.ClientCAs == nil && config.TokenSecret == nil {
+		listener.Close()
+		return ServerError{"gateway has no way to authenticate clients"}
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{config.Certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// Clients may present a certificate instead of a token.
+	if config.ClientCAs != nil {
+		tlsConfig.ClientCAs = config.ClientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// Add the listener to the list so that it can be stopped.
+	s.addListener(listener)
+
+	httpServer := &http.Server{
+		Handler:      &gateway{server: s, tokenSecret: config.TokenSecret},
+		ReadTimeout:  s.limiter.handshakeTimeout(),
+		WriteTimeout: time.Minute,
+	}
+
+	err := httpServer.Serve(tls.NewListener(listener, tlsConfig))
+
+	// A listener closed by Stop is not an error.
+	if s.stopped(listener) {
+		return nil
+	}
+
+	return err
+}
+
+// authenticate determines the caller of a request from its bearer token or,
+// failing that, its client certificate.
+func (g *gateway) authenticate(r *http.Request) (*gatewayCaller, error) {
+
+	c := &gatewayCaller{remoteAddr: gatewayAddr(r.RemoteAddr)}
+
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+
+		if g.tokenSecret == nil || !strings.HasPrefix(authorization, "Bearer ") {
+			return nil, ErrUnauthorized
+		}
+
+		token, err := VerifyToken(g.tokenSecret, strings.TrimPrefix(authorization, "Bearer "), time.Now())
+		if err != nil {
+			return nil, err
+		}
+
+		// The token's name is used as its principal in the policy.
+		if !validPrincipal(token.Name) {
+			return nil, ErrUnauthorized
+		}
+
+		c.user = token.User
+		c.perms = &ssh.Permissions{
+			Extensions: map[string]string{
+				principalsExtension: token.Name,
+				identityExtension:   token.Name,
+			},
+		}
+
+		return c, nil
+	}
+
+	// Client certificates have already been verified by the TLS handshake.
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, ErrUnauthorized
+	}
+
+	certificate := r.TLS.VerifiedChains[0][0]
+
+	c.user = ReaderUser
+	for _, unit := range certificate.Subject.OrganizationalUnit {
+		if unit == GatewayWriterUnit {
+			c.user = WriterUser
+		}
+	}
+
+	// The certificate's common name is used as its principal in the policy.
+	if !validPrincipal(certificate.Subject.CommonName) {
+		return nil, ErrUnauthorized
+	}
+
+	sum := sha256.Sum256(certificate.Raw)
+	c.perms = &ssh.Permissions{
+		Extensions: map[string]string{
+			principalsExtension:  certificate.Subject.CommonName,
+			identityExtension:    certificate.Subject.CommonName,
+			fingerprintExtension: "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]),
+		},
+	}
+
+	return c, nil
+}
+
+// parseGatewayRequest converts an HTTP request into a request for the
+// server. It also returns the name of the variable the request refers to, if
+// any.
+func parseGatewayRequest(r *http.Request) (*Request, string, error) {
+
+	escapedPath := r.URL.EscapedPath()
+	if !strings.HasPrefix(escapedPath, gatewayPrefix) {
+		return nil, "", gatewayNotFound
+	}
+
+	// Unescape each component separately so that names may contain
+	// escaped slashes.
+	components := strings.Split(strings.TrimPrefix(escapedPath, gatewayPrefix), "/")
+	for i, component := range components {
+
+		unescaped, err := url.PathUnescape(component)
+		if err != nil || unescaped == "" {
+			return nil, "", gatewayNotFound
+		}
+
+		components[i] = unescaped
+	}
+
+	request := &Request{Version: ProtocolVersion}
+
+	switch {
+	case len(components) == 1 && components[0] == "groups":
+
+		// List the groups.
+		if r.Method != "GET" {
+			return nil, "", gatewayMethodNotAllowed
+		}
+
+		request.Command = "groups"
+		return request, "", nil
+
+	case len(components) == 3 && components[0] == "groups" && components[2] == "vars":
+
+		// List the variables in a group.
+		if r.Method != "GET" {
+			return nil, "", gatewayMethodNotAllowed
+		}
+
+		request.Command = "env"
+		request.Group = components[1]
+		return request, "", nil
+
+	case len(components) == 4 && components[0] == "groups" && components[2] == "vars":
+
+		request.Group = components[1]
+		variable := components[3]
+
+		switch r.Method {
+		case "GET":
+			request.Command = "env"
+			request.Names = []string{variable}
+
+		case "PUT":
+
+			// The body is a JSON object holding the value.
+			var body struct {
+				Value *string `json:"value"`
+			}
+
+			if err := json.NewDecoder(io.LimitReader(r.Body, MaxMessageLength)).Decode(&body); err != nil || body.Value == nil {
+				return nil, "", invalidRequest(`body must be a JSON object with a "value"`)
+			}
+
+			request.Command = "export"
+			request.Variables = map[string]string{variable: *body.Value}
+
+		case "DELETE":
+			request.Command = "unset"
+			request.Names = []string{variable}
+
+		default:
+			return nil, "", gatewayMethodNotAllowed
+		}
+
+		return request, variable, nil
+	}
+
+	return nil, "", gatewayNotFound
+}
+
+var (
+	gatewayNotFound         = &ProtocolError{Code: ErrorCodeNotFound, Message: "not found"}
+	gatewayMethodNotAllowed = invalidRequest("method not allowed")
+)
+
+// gatewayStatus returns the HTTP status code for an error.
+func gatewayStatus(err *ProtocolError) int {
+
+	if err == gatewayMethodNotAllowed {
+		return http.StatusMethodNotAllowed
+	}
+
+	switch err.Code {
+	case ErrorCodeUnauthorized:
+		return http.StatusForbidden
+	case ErrorCodeSealed:
+		return http.StatusServiceUnavailable
+	case ErrorCodeInvalidRequest, ErrorCodeUnsupportedVersion:
+		return http.StatusBadRequest
+	case ErrorCodeNotFound:
+		return http.StatusNotFound
+	}
+
+	return http.StatusInternalServerError
+}
+
+// writeGatewayJSON writes a value as the JSON body of a response.
+func writeGatewayJSON(w http.ResponseWriter, status int, v interface{}) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	// The status has been sent, so there's nothing to do about an error.
+	json.NewEncoder(w).Encode(v)
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// Count the request as a session so that shutdown waits for it.
+	if !g.server.startSession() {
+		writeGatewayJSON(w, http.StatusServiceUnavailable, &ProtocolError{Code: ErrorCodeInternal, Message: "server is shutting down"})
+		return
+	}
+
+	defer g.server.sessions.Done()
+
+	// Don't leave the rest of the body unread, ignoring any error.
+	defer io.Copy(ioutil.Discard, io.LimitReader(r.Body, MaxMessageLength))
+
+	c, err := g.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="stocker"`)
+		writeGatewayJSON(w, http.StatusUnauthorized, newProtocolError(err))
+		return
+	}
+
+	request, variable, err := parseGatewayRequest(r)
+	if err == nil {
+
+		// Run the request the same way as one made over SSH.
+		var response *Response
+		if response, err = g.server.handle(c.User() == WriterUser, c, request); err == nil {
+			g.respond(w, request, variable, response)
+			return
+		}
+	}
+
+	log.Printf("server: %s: %s\n", describeCaller(c), err.Error())
+
+	protocolErr := newProtocolError(err)
+	writeGatewayJSON(w, gatewayStatus(protocolErr), protocolErr)
+}
+
+// respond writes the response to a successful request.
+func (g *gateway) respond(w http.ResponseWriter, request *Request, variable string, response *Response) {
+
+	switch request.Command {
+	case "groups":
+
+		groups := response.Groups
+		if groups == nil {
+			groups = []string{}
+		}
+
+		writeGatewayJSON(w, http.StatusOK, map[string][]string{"groups": groups})
+
+	case "env":
+
+		variables := response.Variables
+		if variables == nil {
+			variables = map[string]string{}
+		}
+
+		// Respond with every variable unless a single one was requested.
+		if variable == "" {
+			writeGatewayJSON(w, http.StatusOK, map[string]map[string]string{"variables": variables})
+			return
+		}
+
+		value, ok := variables[variable]
+		if !ok {
+			writeGatewayJSON(w, http.StatusNotFound, gatewayNotFound)
+			return
+		}
+
+		writeGatewayJSON(w, http.StatusOK, map[string]string{"name": variable, "value": value})
+
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
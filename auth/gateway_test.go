@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseGatewayRequest(t *testing.T) {
+
+	tests := []struct {
+		method, path, body string
+		command, group     string
+		variable           string
+		code               string
+	}{
+		{method: "GET", path: "/v1/groups", command: "groups"},
+		{method: "GET", path: "/v1/groups/app/vars", command: "env", group: "app"},
+		{method: "GET", path: "/v1/groups/app/vars/A", command: "env", group: "app", variable: "A"},
+		{method: "PUT", path: "/v1/groups/app/vars/A", body: `{"value": "1"}`, command: "export", group: "app", variable: "A"},
+		{method: "DELETE", path: "/v1/groups/app/vars/A", command: "unset", group: "app", variable: "A"},
+		{method: "GET", path: "/v1/groups/a%2Fb/vars", command: "env", group: "a/b"},
+		{method: "PUT", path: "/v1/groups/app/vars/A", body: `{}`, code: ErrorCodeInvalidRequest},
+		{method: "POST", path: "/v1/groups", code: ErrorCodeInvalidRequest},
+		{method: "GET", path: "/v1/groups/app", code: ErrorCodeNotFound},
+		{method: "GET", path: "/v2/groups", code: ErrorCodeNotFound},
+		{method: "GET", path: "/v1/groups//vars", code: ErrorCodeNotFound},
+	}
+
+	for _, test := range tests {
+
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		request, variable, err := parseGatewayRequest(r)
+
+		if test.code != "" {
+			if protocolErr, ok := err.(*ProtocolError); !ok || protocolErr.Code != test.code {
+				t.Errorf("%s %s: expected a %s error but found %v!", test.method, test.path, test.code, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s %s: %s", test.method, test.path, err)
+		} else if request.Command != test.command || request.Group != test.group || variable != test.variable {
+			t.Errorf("%s %s: unexpected request %+v for %q", test.method, test.path, request, variable)
+		}
+	}
+
+	r := httptest.NewRequest("PUT", "/v1/groups/app/vars/A", strings.NewReader(`{"value": "1"}`))
+	if request, _, err := parseGatewayRequest(r); err != nil {
+		t.Error(err)
+	} else if request.Variables["A"] != "1" {
+		t.Error(request.Variables)
+	}
+}
+
+func TestGateway(t *testing.T) {
+
+	s, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := []byte("secret")
+	g := &gateway{server: s.(*server), tokenSecret: secret}
+
+	writerToken, err := SignToken(secret, &Token{User: WriterUser, Name: "writer"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readerToken, err := SignToken(secret, &Token{User: ReaderUser, Name: "reader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, body, token string
+		status                    int
+		response                  string
+	}{
+		{"GET", "/v1/groups/gateway/vars", "", "", http.StatusUnauthorized, ""},
+		{"GET", "/v1/groups/gateway/vars", "", "bad", http.StatusUnauthorized, ""},
+		{"PUT", "/v1/groups/gateway/vars/A", `{"value": "1"}`, readerToken, http.StatusForbidden, ""},
+		{"PUT", "/v1/groups/gateway/vars/A", `{"value": "1"}`, writerToken, http.StatusNoContent, ""},
+		{"GET", "/v1/groups/gateway/vars/A", "", readerToken, http.StatusOK, `{"name":"A","value":"1"}`},
+		{"GET", "/v1/groups/gateway/vars", "", readerToken, http.StatusOK, `{"variables":{"A":"1"}}`},
+		{"GET", "/v1/groups/gateway/vars/B", "", readerToken, http.StatusNotFound, ""},
+		{"DELETE", "/v1/groups/gateway/vars/A", "", writerToken, http.StatusNoContent, ""},
+		{"GET", "/v1/groups/gateway/vars", "", readerToken, http.StatusOK, `{"variables":{}}`},
+	}
+
+	for _, test := range tests {
+
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected status %d but found %d!", test.method, test.path, test.status, w.Code)
+		}
+
+		if body := strings.TrimSpace(w.Body.String()); test.response != "" && body != test.response {
+			t.Errorf("%s %s: unexpected response %s", test.method, test.path, body)
+		}
+	}
+}
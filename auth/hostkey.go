@@ -0,0 +1,290 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// A HostKeyCallback is called by a client during the handshake to verify the
+// server's host key. It should return an error if the key is not trusted.
+type HostKeyCallback func(hostname string, remote net.Addr, key ssh.PublicKey) error
+
+// FingerprintKey returns the SHA-256 fingerprint of a public key in the format
+// used by OpenSSH, such as "SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8".
+func FingerprintKey(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+}
+
+// rejectHostKey is used when no host key verification has been configured,
+// so that clients fail closed.
+func rejectHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	return errors.New("client: host key verification is not configured")
+}
+
+// PinnedHostKey returns a callback that only accepts a host key with the
+// given fingerprint.
+func PinnedHostKey(fingerprint string) HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+
+		// Compare in constant time, ignoring any base 64 padding.
+		actual := FingerprintKey(key)
+		expected := strings.TrimRight(fingerprint, "=")
+		if !hmac.Equal([]byte(actual), []byte(expected)) {
+			return fmt.Errorf("client: host key fingerprint %s does not match %s", actual, expected)
+		}
+
+		return nil
+	}
+}
+
+// knownHost is a single entry in a known_hosts file.
+type knownHost struct {
+	patterns []string
+	key      string
+	revoked  bool
+}
+
+// knownHosts verifies host keys against an OpenSSH known_hosts file.
+type knownHosts struct {
+	filename        string
+	trustOnFirstUse bool
+	hosts           []knownHost
+	mu              sync.Mutex
+}
+
+// KnownHosts returns a callback that verifies host keys against the given
+// known_hosts file. If trustOnFirstUse is set, the key of a host that isn't
+// in the file is accepted and added to it; otherwise it is rejected. A host
+// presenting a different key than the one recorded is always rejected.
+func KnownHosts(filename string, trustOnFirstUse bool) (HostKeyCallback, error) {
+
+	k := &knownHosts{
+		filename:        filename,
+		trustOnFirstUse: trustOnFirstUse,
+	}
+
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) && trustOnFirstUse {
+		return k.check, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Defer the closing of the file, ignoring any error.
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		host := knownHost{}
+
+		// Handle markers. Certificate authorities are not supported, so
+		// those lines are skipped.
+		if strings.HasPrefix(fields[0], "@") {
+			switch fields[0] {
+			case "@revoked":
+				host.revoked = true
+			case "@cert-authority":
+				continue
+			default:
+				return nil, fmt.Errorf("client: unknown marker %s in %s", fields[0], filename)
+			}
+			fields = fields[1:]
+		}
+
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("client: invalid line in %s", filename)
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(fields[1:], " ")))
+		if err != nil {
+			return nil, err
+		}
+
+		host.patterns = strings.Split(fields[0], ",")
+		host.key = SerializeKey(key)
+		k.hosts = append(k.hosts, host)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return k.check, nil
+}
+
+// knownHostName converts an address to the form used in known_hosts files,
+// where hosts on ports other than 22 are written as "[host]:port".
+func knownHostName(address string) string {
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	// An empty host is the local machine.
+	if host == "" {
+		host = "localhost"
+	}
+
+	if port == "22" {
+		return host
+	}
+
+	return fmt.Sprintf("[%s]:%s", host, port)
+}
+
+// matchHostPattern reports whether a known_hosts pattern matches the name.
+// Patterns may be hashed or contain the * and ? wildcards.
+func matchHostPattern(pattern, name string) bool {
+
+	// Hashed patterns have the form |1|salt|hash.
+	if strings.HasPrefix(pattern, "|1|") {
+
+		components := strings.Split(pattern[3:], "|")
+		if len(components) != 2 {
+			return false
+		}
+
+		salt, err := base64.StdEncoding.DecodeString(components[0])
+		if err != nil {
+			return false
+		}
+
+		hash, err := base64.StdEncoding.DecodeString(components[1])
+		if err != nil {
+			return false
+		}
+
+		signer := hmac.New(sha1.New, salt)
+		signer.Write([]byte(name))
+		return hmac.Equal(signer.Sum(nil), hash)
+	}
+
+	// Names such as "[host]:2022" must match themselves, so compare
+	// literally before trying wildcards.
+	return pattern == name || matchWildcard(pattern, name)
+}
+
+// matchWildcard reports whether the name matches a pattern in which * matches
+// any run of characters and ? matches any single character, as in OpenSSH.
+// Every other character, including [ and ], only matches itself.
+func matchWildcard(pattern, name string) bool {
+
+	// Backtrack to just after the last * whenever the rest doesn't match.
+	p, n := 0, 0
+	star, starName := -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case p < len(pattern) && pattern[p] == '*':
+			star, starName = p, n
+			p++
+		case star >= 0:
+			starName++
+			p, n = star+1, starName
+		default:
+			return false
+		}
+	}
+
+	// Any remaining pattern must be made up of *s.
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// matches reports whether the entry applies to the name. A matching negated
+// pattern excludes the name even if another pattern matches it.
+func (host *knownHost) matches(name string) bool {
+
+	matched := false
+	for _, pattern := range host.patterns {
+		if strings.HasPrefix(pattern, "!") {
+			if matchHostPattern(pattern[1:], name) {
+				return false
+			}
+		} else if matchHostPattern(pattern, name) {
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+func (k *knownHosts) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	name := knownHostName(hostname)
+	serialized := SerializeKey(key)
+
+	// Look for the host, rejecting revoked keys wherever they appear.
+	found := false
+	for _, host := range k.hosts {
+
+		if host.revoked {
+			if host.key == serialized && host.matches(name) {
+				return fmt.Errorf("client: host key for %s has been revoked", name)
+			}
+			continue
+		}
+
+		if host.matches(name) {
+			if host.key == serialized {
+				return nil
+			}
+			found = true
+		}
+	}
+
+	if found {
+		return fmt.Errorf("client: host key for %s does not match %s", name, k.filename)
+	}
+
+	if !k.trustOnFirstUse {
+		return fmt.Errorf("client: %s is not in %s", name, k.filename)
+	}
+
+	// Trust the key and record it for next time.
+	file, err := os.OpenFile(k.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Defer the closing of the file, ignoring any error.
+	defer file.Close()
+
+	line := bytes.NewBufferString(name)
+	line.WriteString(" ")
+	line.Write(ssh.MarshalAuthorizedKey(key))
+	if _, err := file.Write(line.Bytes()); err != nil {
+		return err
+	}
+
+	k.hosts = append(k.hosts, knownHost{patterns: []string{name}, key: serialized})
+	return nil
+}
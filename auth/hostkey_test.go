@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHosts(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var keys []ssh.PublicKey
+	for _, publicKey := range ServerTestPublicKeys {
+		publicKeyParsed, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, publicKeyParsed)
+	}
+
+	filename := filepath.Join(dir, "known_hosts")
+	knownHostsData := "# stocker servers\n[stocker.example.com]:2022 " + string(ServerTestPublicKeys[0]) + "@revoked * " + string(ServerTestPublicKeys[2])
+	if err := ioutil.WriteFile(filename, []byte(knownHostsData), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2022}
+
+	check, err := KnownHosts(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check("stocker.example.com:2022", remote, keys[0]); err != nil {
+		t.Error(err)
+	}
+
+	if err := check("stocker.example.com:2022", remote, keys[1]); err == nil {
+		t.Error("mismatched host key was accepted")
+	}
+
+	if err := check("other.example.com:2022", remote, keys[1]); err == nil {
+		t.Error("unknown host was accepted")
+	}
+
+	if err := check("other.example.com:2022", remote, keys[2]); err == nil {
+		t.Error("revoked host key was accepted")
+	}
+
+	// With trust on first use, an unknown host is accepted and recorded.
+	check, err = KnownHosts(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check("other.example.com:2022", remote, keys[1]); err != nil {
+		t.Error(err)
+	}
+
+	check, err = KnownHosts(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check("other.example.com:2022", remote, keys[1]); err != nil {
+		t.Error(err)
+	}
+
+	if err := check("other.example.com:2022", remote, keys[0]); err == nil {
+		t.Error("mismatched host key was accepted after first use")
+	}
+}
+
+func TestKnownHostsTrustOnFirstUse(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var keys []ssh.PublicKey
+	for _, publicKey := range ServerTestPublicKeys[:2] {
+		publicKeyParsed, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, publicKeyParsed)
+	}
+
+	filename := filepath.Join(dir, "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2022}
+
+	check, err := KnownHosts(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first key seen on port 2022 is recorded as "[host]:2022"...
+	if err := check("stocker.example.com:2022", remote, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// ...and a different key is then rejected, even by a new callback that
+	// reads the recorded entry back from the file.
+	if err := check("stocker.example.com:2022", remote, keys[1]); err == nil {
+		t.Error("a second host key was accepted after first use")
+	}
+
+	check, err = KnownHosts(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := check("stocker.example.com:2022", remote, keys[1]); err == nil {
+		t.Error("a second host key was accepted after reloading")
+	}
+
+	if err := check("stocker.example.com:2022", remote, keys[0]); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMatchHostPattern(t *testing.T) {
+
+	for _, test := range []struct {
+		pattern, name string
+		matched       bool
+	}{
+		{"[stocker.example.com]:2022", "[stocker.example.com]:2022", true},
+		{"[stocker.example.com]:2022", "[other.example.com]:2022", false},
+		{"[s]:2022", "s", false},
+		{"stocker.example.com", "stocker.example.com", true},
+		{"*.example.com", "stocker.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"[*.example.com]:2022", "[stocker.example.com]:2022", true},
+		{"stocker?.example.com", "stocker1.example.com", true},
+		{"stocker?.example.com", "stocker.example.com", false},
+		{"*", "anything", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+	} {
+		if matched := matchHostPattern(test.pattern, test.name); matched != test.matched {
+			t.Errorf("expected %q matching %q to be %t", test.pattern, test.name, test.matched)
+		}
+	}
+}
+
+func TestPinnedHostKey(t *testing.T) {
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(ServerTestPublicKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PinnedHostKey(FingerprintKey(key))("localhost:2022", nil, key); err != nil {
+		t.Error(err)
+	}
+
+	other, _, _, _, err := ssh.ParseAuthorizedKey(ServerTestPublicKeys[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PinnedHostKey(FingerprintKey(key))("localhost:2022", nil, other); err == nil {
+		t.Error("host key with the wrong fingerprint was accepted")
+	}
+}
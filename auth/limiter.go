@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits protect a server from clients making too many connections or
+// authentication attempts. A zero value disables the corresponding limit.
+type Limits struct {
+
+	// MaxConnections is the maximum number of concurrent connections.
+	MaxConnections int
+
+	// HandshakeTimeout is how long a client has to complete the SSH
+	// handshake, including authentication.
+	HandshakeTimeout time.Duration
+
+	// AuthAttempts is the maximum number of authentication attempts a host
+	// may make in each Window. Every key a client offers is an attempt.
+	AuthAttempts int
+
+	// BanAfter is the number of handshakes within a Window that may fail
+	// after a key was rejected before a host is banned for BanDuration.
+	// Handshakes that fail before any key is offered aren't counted.
+	BanAfter    int
+	BanDuration time.Duration
+
+	// Window is the period over which attempts and failures are counted.
+	Window time.Duration
+}
+
+// DefaultLimits are the limits used unless others are set.
+var DefaultLimits = Limits{
+	MaxConnections:   100,
+	HandshakeTimeout: 10 * time.Second,
+	AuthAttempts:     20,
+	BanAfter:         5,
+	BanDuration:      15 * time.Minute,
+	Window:           time.Minute,
+}
+
+// hostRecord tracks a single remote host.
+type hostRecord struct {
+	windowStart        time.Time
+	attempts, failures int
+	bannedUntil        time.Time
+}
+
+// A limiter enforces Limits, tracking connections and remote hosts.
+type limiter struct {
+	limits      Limits
+	connections int
+	hosts       map[string]*hostRecord
+	lastPrune   time.Time
+	mu          sync.Mutex
+}
+
+func newLimiter(limits Limits) *limiter {
+	return &limiter{
+		limits: limits,
+		hosts:  make(map[string]*hostRecord),
+	}
+}
+
+// remoteHost returns the host portion of a remote address. Peers on a Unix
+// socket have no host, so the empty string is returned for them and they are
+// exempt from the per-host limits; access to the socket is controlled by its
+// permissions instead.
+func remoteHost(addr net.Addr) string {
+
+	if addr.Network() == "unix" {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
+
+// setLimits replaces the limits. Existing connections and records are kept.
+func (l *limiter) setLimits(limits Limits) {
+
+	// Get the limiter lock.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limits = limits
+}
+
+// handshakeTimeout returns the current handshake timeout.
+func (l *limiter) handshakeTimeout() time.Duration {
+
+	// Get the limiter lock.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.limits.HandshakeTimeout
+}
+
+// record returns the record for the host, starting a new window if the
+// current one has expired. The lock must be held.
+func (l *limiter) record(host string, now time.Time) *hostRecord {
+
+	l.prune(now)
+
+	r, ok := l.hosts[host]
+	if !ok {
+		r = &hostRecord{windowStart: now}
+		l.hosts[host] = r
+	} else if now.Sub(r.windowStart) >= l.limits.Window {
+		r.windowStart = now
+		r.attempts = 0
+		r.failures = 0
+	}
+
+	return r
+}
+
+// prune removes records that are neither banned nor within a window, at most
+// once per window. The lock must be held.
+func (l *limiter) prune(now time.Time) {
+
+	if now.Sub(l.lastPrune) < l.limits.Window {
+		return
+	}
+	l.lastPrune = now
+
+	for host, r := range l.hosts {
+		if now.Sub(r.windowStart) >= l.limits.Window && !now.Before(r.bannedUntil) {
+			delete(l.hosts, host)
+		}
+	}
+}
+
+// acquire reserves a connection for the host. It returns false if the host
+// is banned or the server has reached its maximum number of connections.
+func (l *limiter) acquire(host string, now time.Time) bool {
+
+	// Get the limiter lock.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r, ok := l.hosts[host]; ok && host != "" && now.Before(r.bannedUntil) {
+		return false
+	}
+
+	if l.limits.MaxConnections > 0 && l.connections >= l.limits.MaxConnections {
+		return false
+	}
+
+	l.connections++
+	return true
+}
+
+// release frees a connection reserved by acquire.
+func (l *limiter) release() {
+
+	// Get the limiter lock.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.connections--
+}
+
+// attempt counts an authentication attempt by the host. It returns false if
+// the host has made too many attempts in the current window. Attempts by
+// Unix socket peers, whose host is empty, are not limited.
+func (l *limiter) attempt(host string, now time.Time) bool {
+
+	// Get the limiter lock.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.AuthAttempts <= 0 || host == "" {
+		return true
+	}
+
+	r := l.record(host, now)
+	r.attempts++
+
+	return r.attempts <= l.limits.AuthAttempts
+}
+
+// fail counts a failed handshake by the host, banning it once it has failed
+// too many times in the current window. It returns true if the host has been
+// banned. Unix socket peers, whose host is empty, are never banned.
+func (l *limiter) fail(host string, now time.Time) bool {
+
+	// Get the limiter lock.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.BanAfter <= 0 || host == "" {
+		return false
+	}
+
+	r := l.record(host, now)
+	r.failures++
+
+	if r.failures < l.limits.BanAfter {
+		return false
+	}
+
+	r.bannedUntil = now.Add(l.limits.BanDuration)
+	r.failures = 0
+	return true
+}
+
+// succeed clears the failures of a host that has completed a handshake.
+func (l *limiter) succeed(host string) {
+
+	// Get the limiter lock.
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r, ok := l.hosts[host]; ok {
+		r.failures = 0
+	}
+}
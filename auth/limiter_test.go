@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLimiterConnections(t *testing.T) {
+
+	l := newLimiter(Limits{MaxConnections: 2})
+	now := time.Now()
+
+	if !l.acquire("192.0.2.1", now) || !l.acquire("192.0.2.2", now) {
+		t.Fatal("connection below the maximum was refused")
+	}
+
+	if l.acquire("192.0.2.3", now) {
+		t.Error("connection above the maximum was accepted")
+	}
+
+	l.release()
+	if !l.acquire("192.0.2.3", now) {
+		t.Error("connection was refused after one was released")
+	}
+}
+
+func TestLimiterAttempts(t *testing.T) {
+
+	l := newLimiter(Limits{AuthAttempts: 3, Window: time.Minute})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !l.attempt("192.0.2.1", now) {
+			t.Fatalf("attempt %d was refused", i+1)
+		}
+	}
+
+	if l.attempt("192.0.2.1", now) {
+		t.Error("attempt above the limit was allowed")
+	}
+
+	if !l.attempt("192.0.2.2", now) {
+		t.Error("attempt from another host was refused")
+	}
+
+	// The count starts again in the next window.
+	if !l.attempt("192.0.2.1", now.Add(time.Minute)) {
+		t.Error("attempt in a new window was refused")
+	}
+}
+
+func TestLimiterBan(t *testing.T) {
+
+	l := newLimiter(Limits{BanAfter: 2, BanDuration: 10 * time.Minute, Window: time.Minute})
+	now := time.Now()
+
+	if l.fail("192.0.2.1", now) {
+		t.Fatal("host was banned after one failure")
+	}
+
+	if !l.fail("192.0.2.1", now) {
+		t.Fatal("host was not banned after two failures")
+	}
+
+	if l.acquire("192.0.2.1", now.Add(5*time.Minute)) {
+		t.Error("banned host was allowed to connect")
+	}
+
+	if !l.acquire("192.0.2.1", now.Add(10*time.Minute)) {
+		t.Error("host was still banned after the ban expired")
+	}
+
+	// A successful handshake clears earlier failures.
+	l.fail("192.0.2.2", now)
+	l.succeed("192.0.2.2")
+	if l.fail("192.0.2.2", now) {
+		t.Error("host was banned despite a successful handshake")
+	}
+}
+
+func TestLimiterUnixPeers(t *testing.T) {
+
+	l := newLimiter(Limits{AuthAttempts: 1, BanAfter: 1, BanDuration: time.Hour, Window: time.Minute})
+	now := time.Now()
+
+	host := remoteHost(&net.UnixAddr{Name: "@", Net: "unix"})
+	if host != "" {
+		t.Fatalf("expected no host for a Unix peer but found %q", host)
+	}
+
+	// Unix peers share no host, so they must not share a bucket either.
+	for i := 0; i < 3; i++ {
+		if !l.attempt(host, now) {
+			t.Errorf("attempt %d by a Unix peer was refused", i+1)
+		}
+
+		if l.fail(host, now) {
+			t.Error("a Unix peer was banned")
+		}
+	}
+
+	if !l.acquire(host, now) {
+		t.Error("connection from a Unix peer was refused")
+	}
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// unixPrefix marks an address as the path of a Unix socket.
+const unixPrefix = `unix:`
+
+// DefaultSocketMode is the permissions given to Unix sockets by
+// ListenAndServe.
+const DefaultSocketMode os.FileMode = 0660
+
+// systemdListenFdsStart is the first file descriptor passed by systemd.
+const systemdListenFdsStart = 3
+
+// ParseAddress splits an address into a network and an address for that
+// network. Addresses prefixed with "unix:", such as "unix:/run/stocker.sock",
+// are Unix sockets, and all others are TCP addresses.
+func ParseAddress(address string) (string, string) {
+
+	if strings.HasPrefix(address, unixPrefix) {
+		return "unix", strings.TrimPrefix(address, unixPrefix)
+	}
+
+	return "tcp", address
+}
+
+// Dial connects to an address in the form accepted by ParseAddress.
+func Dial(address string) (net.Conn, error) {
+
+	network, address := ParseAddress(address)
+	return net.Dial(network, address)
+}
+
+// Listen listens on an address in the form accepted by ParseAddress. A Unix
+// socket is created with the given permissions, replacing any stale socket
+// left by a server that didn't shut down cleanly.
+func Listen(address string, mode os.FileMode) (net.Listener, error) {
+
+	network, address := ParseAddress(address)
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	// Remove the socket if nothing is listening on it. A socket that is in
+	// use, or a file that isn't a socket, is left alone so that Listen fails.
+	if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial(network, address); err == nil {
+			conn.Close()
+		} else {
+			os.Remove(address)
+		}
+	}
+
+	// Create the socket with the permissions already in place, rather than
+	// changing them afterwards, so that it is never more widely accessible.
+	umask := syscall.Umask(int(^mode & os.ModePerm))
+	listener, err := net.Listen(network, address)
+	syscall.Umask(umask)
+
+	return listener, err
+}
+
+// SystemdListeners returns the listeners passed by systemd socket
+// activation, in order. It returns no listeners if the process was not
+// activated. The variables systemd sets are removed from the environment so
+// that child processes don't inherit them.
+func SystemdListeners() ([]net.Listener, error) {
+
+	// The listeners are only meant for us if the PID matches.
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, ServerError{"invalid LISTEN_FDS"}
+	}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := systemdListenFdsStart; fd < systemdListenFdsStart+n; fd++ {
+
+		// Don't leak the descriptor to child processes.
+		syscall.CloseOnExec(fd)
+
+		// FileListener duplicates the descriptor, so the file can be closed
+		// once the listener has been made.
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+
+			return nil, err
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+
+	if network, address := ParseAddress(":2022"); network != "tcp" || address != ":2022" {
+		t.Errorf("unexpected network %s and address %s", network, address)
+	}
+
+	if network, address := ParseAddress("unix:/run/stocker.sock"); network != "unix" || address != "/run/stocker.sock" {
+		t.Errorf("unexpected network %s and address %s", network, address)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stocker.sock")
+
+	listener, err := Listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if mode := info.Mode() & os.ModePerm; mode != 0600 {
+		t.Errorf("expected mode 0600 but found %o!", mode)
+	}
+
+	// A socket that is in use shouldn't be replaced.
+	if _, err := Listen("unix:"+path, 0600); err == nil {
+		t.Error("replaced a socket in use")
+	}
+
+	conn, err := Dial("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.Close()
+
+	// Leave the socket file behind, as a server that crashed would.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	listener, err = Listen("unix:"+path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener.Close()
+}
+
+func TestSystemdListeners(t *testing.T) {
+
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	// Listeners meant for another process should be ignored.
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	if listeners, err := SystemdListeners(); err != nil || len(listeners) != 0 {
+		t.Errorf("unexpected listeners %v and error %v", listeners, err)
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "0")
+
+	if listeners, err := SystemdListeners(); err != nil || len(listeners) != 0 {
+		t.Errorf("unexpected listeners %v and error %v", listeners, err)
+	}
+
+	if os.Getenv("LISTEN_PID") != "" {
+		t.Error("LISTEN_PID was not removed from the environment")
+	}
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "-1")
+
+	if _, err := SystemdListeners(); err == nil {
+		t.Error("accepted a negative LISTEN_FDS")
+	}
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"path"
+)
+
+const (
+	ReadOperation  = `read`
+	WriteOperation = `write`
+)
+
+// A Policy maps public keys and certificate principals to the groups they may
+// read and write. Group patterns use the syntax of path.Match, so "app-*"
+// matches every group beginning with "app-".
+type Policy struct {
+	entries []*policyEntry
+}
+
+// policyEntry is a single named identity in a policy.
+type policyEntry struct {
+	Name             string
+	Keys, Principals []string
+	Read, Write      []string
+
+	// serializedKeys holds the parsed and serialized form of Keys.
+	serializedKeys map[string]bool
+}
+
+// ParsePolicy parses a JSON policy of the form:
+//
+//	[
+//		{
+//			"name": "deploy",
+//			"keys": ["ssh-rsa AAAA... deploy@example.com"],
+//			"principals": ["deploy"],
+//			"read": ["app-*"],
+//			"write": ["app-staging"]
+//		}
+//	]
+//
+// Keys are in the OpenSSH authorized_keys format. An entry applies to a
+// connection that authenticated with one of its keys, or with a certificate
+// listing one of its principals.
+func ParsePolicy(data []byte) (*Policy, error) {
+
+	p := &Policy{}
+	if err := json.Unmarshal(data, &p.entries); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range p.entries {
+
+		entry.serializedKeys = make(map[string]bool)
+		for _, rawKey := range entry.Keys {
+
+			// We're only interested in the key itself and whether or not
+			// there was an error.
+			publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(rawKey))
+			if err != nil {
+				return nil, err
+			}
+
+			entry.serializedKeys[SerializeKey(publicKey)] = true
+		}
+
+		// Check that every pattern is valid now rather than silently
+		// failing to match later.
+		for _, pattern := range append(entry.Read, entry.Write...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// LoadPolicy reads and parses a policy file.
+func LoadPolicy(filename string) (*Policy, error) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(data)
+}
+
+// Allowed reports whether the given serialized key or certificate principals
+// may perform the operation on the group. Write permission on a group implies
+// read permission.
+func (p *Policy) Allowed(key string, principals []string, operation, group string) bool {
+
+	for _, entry := range p.entries {
+
+		if !entry.matches(key, principals) {
+			continue
+		}
+
+		if matchGroup(entry.Write, group) {
+			return true
+		}
+
+		if operation == ReadOperation && matchGroup(entry.Read, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches reports whether the entry applies to the key or any of the
+// principals.
+func (entry *policyEntry) matches(key string, principals []string) bool {
+
+	if entry.serializedKeys[key] {
+		return true
+	}
+
+	for _, principal := range principals {
+		for _, entryPrincipal := range entry.Principals {
+			if principal == entryPrincipal {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matchGroup reports whether the group matches any of the patterns.
+func matchGroup(patterns []string, group string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, group); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"encoding/json"
+	"golang.org/x/crypto/ssh"
+	"strings"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+
+	// Give the first key read access to app-* and write access to
+	// app-staging, and leave the second key out of the policy.
+	policyJSON, err := json.Marshal([]map[string]interface{}{
+		{
+			"name":  "deploy",
+			"keys":  []string{strings.TrimSpace(string(ServerTestPublicKeys[0]))},
+			"read":  []string{"app-*"},
+			"write": []string{"app-staging"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := ParsePolicy(policyJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for _, publicKey := range ServerTestPublicKeys[:2] {
+		publicKeyParsed, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, SerializeKey(publicKeyParsed))
+	}
+
+	tests := []struct {
+		key, operation, group string
+		allowed               bool
+	}{
+		{keys[0], ReadOperation, "app-production", true},
+		{keys[0], WriteOperation, "app-production", false},
+		{keys[0], ReadOperation, "app-staging", true},
+		{keys[0], WriteOperation, "app-staging", true},
+		{keys[0], ReadOperation, "other", false},
+		{keys[1], ReadOperation, "app-production", false},
+	}
+
+	for _, test := range tests {
+		if allowed := policy.Allowed(test.key, nil, test.operation, test.group); allowed != test.allowed {
+			t.Errorf("expected %s on %s to be %t but found %t!", test.operation, test.group, test.allowed, allowed)
+		}
+	}
+}
+
+func TestPolicyPrincipals(t *testing.T) {
+
+	policy, err := ParsePolicy([]byte(`[{"name": "ops", "principals": ["ops"], "write": ["*"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !policy.Allowed("", []string{"w", "ops"}, WriteOperation, "app-production") {
+		t.Error("principal was not allowed to write")
+	}
+
+	if policy.Allowed("", []string{"w", "dev"}, ReadOperation, "app-production") {
+		t.Error("unknown principal was allowed to read")
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	if _, err := ParsePolicy([]byte(`[{"name": "bad", "read": ["["]}]`)); err == nil {
+		t.Error("policy with an invalid pattern was accepted")
+	}
+}
@@ -0,0 +1,312 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"math/big"
+)
+
+const (
+
+	// openSSHKeyType is the PEM type of keys in the OpenSSH format, which
+	// ssh-keygen uses by default.
+	openSSHKeyType = `OPENSSH PRIVATE KEY`
+
+	// openSSHKeyMagic begins every key in the OpenSSH format.
+	openSSHKeyMagic = "openssh-key-v1\x00"
+)
+
+var (
+	// ErrPassphraseRequired is returned when a private key is encrypted but
+	// there is no way to get its passphrase.
+	ErrPassphraseRequired = ClientError{"the private key is encrypted and no passphrase was given"}
+
+	// ErrIncorrectPassphrase is returned when a private key can't be
+	// decrypted with the passphrase given.
+	ErrIncorrectPassphrase = ClientError{"incorrect passphrase for the private key"}
+
+	// errMalformedKey is returned for private keys that can't be parsed.
+	errMalformedKey = ClientError{"malformed private key"}
+)
+
+// A PassphraseFunc returns the passphrase of an encrypted private key,
+// typically by prompting for it.
+type PassphraseFunc func() ([]byte, error)
+
+// ParsePrivateKey parses a private key in the OpenSSH format or PEM encoded.
+// If the key is encrypted, passphrase is called to get its passphrase; if
+// passphrase is nil, ErrPassphraseRequired is returned instead.
+func ParsePrivateKey(data []byte, passphrase PassphraseFunc) (ssh.Signer, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ClientError{"no PEM encoded private key found"}
+	}
+
+	// Keys in the OpenSSH format, encrypted or not.
+	if block.Type == openSSHKeyType {
+
+		key, err := parseOpenSSHPrivateKey(block.Bytes, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		return ssh.NewSignerFromKey(key)
+	}
+
+	// PEM encoded keys with the encryption described in their headers.
+	if x509.IsEncryptedPEMBlock(block) {
+
+		der, err := decryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der}))
+		if err != nil {
+			return nil, err
+		}
+
+		return ssh.NewSignerFromKey(key)
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+// decryptPEMBlock decrypts an encrypted PEM block, returning its DER bytes.
+func decryptPEMBlock(block *pem.Block, passphrase PassphraseFunc) ([]byte, error) {
+
+	if passphrase == nil {
+		return nil, ErrPassphraseRequired
+	}
+
+	password, err := passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.DecryptPEMBlock(block, password)
+	if err == x509.IncorrectPasswordError {
+		return nil, ErrIncorrectPassphrase
+	}
+
+	return der, err
+}
+
+// parseOpenSSHPrivateKey parses the body of a key in the OpenSSH format, as
+// described in PROTOCOL.key in the OpenSSH source, returning an
+// *rsa.PrivateKey or an *ecdsa.PrivateKey.
+func parseOpenSSHPrivateKey(data []byte, passphrase PassphraseFunc) (interface{}, error) {
+
+	if !bytes.HasPrefix(data, []byte(openSSHKeyMagic)) {
+		return nil, errMalformedKey
+	}
+
+	r := &keyReader{data: data[len(openSSHKeyMagic):]}
+	cipherName := string(r.bytes())
+	kdfName := string(r.bytes())
+	kdfOptions := r.bytes()
+	n := r.uint32()
+	r.bytes()
+	private := r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if n != 1 {
+		return nil, ClientError{"files containing more than one private key are not supported"}
+	}
+
+	encrypted := cipherName != "none"
+	if encrypted {
+
+		if kdfName != "bcrypt" {
+			return nil, ClientError{fmt.Sprintf("unsupported key derivation function %s", kdfName)}
+		}
+
+		if passphrase == nil {
+			return nil, ErrPassphraseRequired
+		}
+
+		password, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+
+		private, err = decryptOpenSSHPrivateKey(cipherName, kdfOptions, password, private)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The private section starts with a random number written twice, which
+	// only match if it was decrypted correctly.
+	r = &keyReader{data: private}
+	if check1, check2 := r.uint32(), r.uint32(); r.err == nil && check1 != check2 {
+		if encrypted {
+			return nil, ErrIncorrectPassphrase
+		}
+
+		return nil, errMalformedKey
+	}
+
+	switch keyType := string(r.bytes()); keyType {
+	case "ssh-rsa":
+
+		n, e, d, _, p, q := r.bigInt(), r.bigInt(), r.bigInt(), r.bigInt(), r.bigInt(), r.bigInt()
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+
+		key.Precompute()
+		return key, nil
+
+	case "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521":
+
+		curveName, point, d := string(r.bytes()), r.bytes(), r.bigInt()
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		var curve elliptic.Curve
+		switch curveName {
+		case "nistp256":
+			curve = elliptic.P256()
+		case "nistp384":
+			curve = elliptic.P384()
+		case "nistp521":
+			curve = elliptic.P521()
+		default:
+			return nil, errMalformedKey
+		}
+
+		x, y := elliptic.Unmarshal(curve, point)
+		if x == nil {
+			return nil, errMalformedKey
+		}
+
+		return &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y}, D: d}, nil
+
+	default:
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		return nil, ClientError{fmt.Sprintf("unsupported private key type %s", keyType)}
+	}
+}
+
+// decryptOpenSSHPrivateKey decrypts the private section of a key in the
+// OpenSSH format.
+func decryptOpenSSHPrivateKey(cipherName string, kdfOptions, password, data []byte) ([]byte, error) {
+
+	var keyLen int
+	var cbc bool
+	switch cipherName {
+	case "aes128-ctr":
+		keyLen = 16
+	case "aes192-ctr":
+		keyLen = 24
+	case "aes256-ctr":
+		keyLen = 32
+	case "aes128-cbc":
+		keyLen, cbc = 16, true
+	case "aes192-cbc":
+		keyLen, cbc = 24, true
+	case "aes256-cbc":
+		keyLen, cbc = 32, true
+	default:
+		return nil, ClientError{fmt.Sprintf("unsupported private key cipher %s", cipherName)}
+	}
+
+	options := &keyReader{data: kdfOptions}
+	salt, rounds := options.bytes(), options.uint32()
+	if options.err != nil {
+		return nil, options.err
+	}
+
+	if len(data)%aes.BlockSize != 0 {
+		return nil, errMalformedKey
+	}
+
+	// Derive the key and the IV together.
+	derived, err := bcryptPBKDF(password, salt, int(rounds), keyLen+aes.BlockSize)
+	if err != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+
+	block, err := aes.NewCipher(derived[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+
+	iv := derived[keyLen:]
+	decrypted := make([]byte, len(data))
+	if cbc {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, data)
+	} else {
+		cipher.NewCTR(block, iv).XORKeyStream(decrypted, data)
+	}
+
+	return decrypted, nil
+}
+
+// keyReader reads the fields of a key in the OpenSSH format. Once a field
+// can't be read, every later read returns a zero value and err is set.
+type keyReader struct {
+	data []byte
+	err  error
+}
+
+func (r *keyReader) uint32() uint32 {
+
+	if r.err != nil || len(r.data) < 4 {
+		r.err = errMalformedKey
+		return 0
+	}
+
+	value := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+
+	return value
+}
+
+// bytes reads a string, which is a length prefixed byte slice.
+func (r *keyReader) bytes() []byte {
+
+	n := r.uint32()
+	if r.err != nil || uint32(len(r.data)) < n {
+		r.err = errMalformedKey
+		return nil
+	}
+
+	value := r.data[:n]
+	r.data = r.data[n:]
+
+	return value
+}
+
+// bigInt reads an mpint, which is a string holding a big-endian integer.
+// Negative integers never appear in private keys and aren't supported.
+func (r *keyReader) bigInt() *big.Int {
+	return new(big.Int).SetBytes(r.bytes())
+}
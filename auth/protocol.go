@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/buth/stocker/crypto"
+	"io"
+)
+
+const (
+
+	// SubsystemName is the SSH subsystem clients request to use the
+	// structured protocol instead of exec commands.
+	SubsystemName = `stocker`
+
+	// KeepSessionVariable is the environment variable clients set to "1" to
+	// run more than one exec command in a session. Each command's result is
+	// then written as a response message, and the session stays open until
+	// the client closes it.
+	KeepSessionVariable = `STOCKER_KEEP_SESSION`
+
+	// ProtocolVersion is the version of the structured protocol. Requests
+	// with any other version are rejected.
+	ProtocolVersion = 1
+
+	// MaxMessageLength is the largest message either side will read.
+	MaxMessageLength = 1 << 20
+)
+
+// Error codes identify the kind of a ProtocolError.
+const (
+	ErrorCodeUnauthorized       = `unauthorized`
+	ErrorCodeSealed             = `sealed`
+	ErrorCodeInvalidRequest     = `invalid_request`
+	ErrorCodeUnsupportedVersion = `unsupported_version`
+	ErrorCodeDecrypt            = `decrypt`
+	ErrorCodeInternal           = `internal`
+
+	// ErrorCodeNotFound is only used by the HTTPS gateway.
+	ErrorCodeNotFound = `not_found`
+)
+
+var (
+	ErrUnauthorized = ServerError{"unauthorized"}
+	ErrSealed       = ServerError{"sealed"}
+)
+
+// A Request is a single command sent using the structured protocol.
+//
+// For the export command, Variables maps the names of the variables to set to
+// their values. For the unset command, Names lists the variables to remove,
+// and for the env command, Names optionally limits the variables returned.
+// The unseal and keys commands take their argument as they would over exec.
+type Request struct {
+	Version   int               `json:"version"`
+	Command   string            `json:"command"`
+	Group     string            `json:"group,omitempty"`
+	Variables map[string]string `json:"variables,omitempty"`
+	Names     []string          `json:"names,omitempty"`
+	Argument  string            `json:"argument,omitempty"`
+}
+
+// A Response answers a Request. If the command failed, Error is set and the
+// other fields should be ignored.
+type Response struct {
+	Version   int               `json:"version"`
+	Variables map[string]string `json:"variables,omitempty"`
+	Groups    []string          `json:"groups,omitempty"`
+	Remaining int               `json:"remaining,omitempty"`
+	Output    string            `json:"output,omitempty"`
+	Error     *ProtocolError    `json:"error,omitempty"`
+}
+
+// A ProtocolError is an error reported to a client. The code identifies the
+// kind of error and the message describes it.
+type ProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// invalidRequest returns an error describing a malformed request.
+func invalidRequest(message string) *ProtocolError {
+	return &ProtocolError{Code: ErrorCodeInvalidRequest, Message: message}
+}
+
+// newProtocolError converts an error raised while handling a request into
+// one that can be reported to the client.
+func newProtocolError(err error) *ProtocolError {
+
+	if protocolErr, ok := err.(*ProtocolError); ok {
+		return protocolErr
+	}
+
+	switch err {
+	case ErrUnauthorized:
+		return &ProtocolError{Code: ErrorCodeUnauthorized, Message: err.Error()}
+	case ErrSealed:
+		return &ProtocolError{Code: ErrorCodeSealed, Message: err.Error()}
+	}
+
+	if _, ok := err.(crypto.CrypterError); ok {
+		return &ProtocolError{Code: ErrorCodeDecrypt, Message: err.Error()}
+	}
+
+	return &ProtocolError{Code: ErrorCodeInternal, Message: err.Error()}
+}
+
+// WriteMessage writes a value as JSON, prefixed by its length as a 4-byte,
+// big-endian integer.
+func WriteMessage(w io.Writer, v interface{}) error {
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if len(data) > MaxMessageLength {
+		return ServerError{"message too long"}
+	}
+
+	// Write the length and the message together so that they aren't split
+	// across channel packets unnecessarily.
+	message := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(message, uint32(len(data)))
+	copy(message[4:], data)
+
+	_, err = w.Write(message)
+	return err
+}
+
+// ReadMessage reads a message written by WriteMessage into v. It returns
+// io.EOF if the stream ends cleanly before a message.
+func ReadMessage(r io.Reader, v interface{}) error {
+
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return err
+	}
+
+	if n > MaxMessageLength {
+		return ServerError{"message too long"}
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestProtocolMessages(t *testing.T) {
+
+	buffer := bytes.NewBuffer([]byte{})
+
+	requests := []*Request{
+		{Version: ProtocolVersion, Command: "export", Group: "test", Variables: map[string]string{"A": "1"}},
+		{Version: ProtocolVersion, Command: "unset", Group: "test", Names: []string{"A"}},
+	}
+
+	for _, request := range requests {
+		if err := WriteMessage(buffer, request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range requests {
+
+		request := &Request{}
+		if err := ReadMessage(buffer, request); err != nil {
+			t.Fatal(err)
+		}
+
+		if request.Command != expected.Command || request.Group != expected.Group {
+			t.Errorf("expected %v but found %v!", expected, request)
+		}
+	}
+
+	if err := ReadMessage(buffer, &Request{}); err != io.EOF {
+		t.Errorf("expected EOF but found %v!", err)
+	}
+
+	// Lengths beyond the maximum should be refused before reading.
+	if err := ReadMessage(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}), &Request{}); err == nil {
+		t.Error("read a message longer than the maximum")
+	}
+}
+
+func TestParseExecCommand(t *testing.T) {
+
+	environment := map[string]string{"GROUP": "test", "B": "from-env"}
+
+	request := parseExecCommand(environment, "export A=1")
+	if request.Command != "export" || request.Group != "test" || request.Variables["A"] != "1" {
+		t.Errorf("unexpected request %v", request)
+	}
+
+	request = parseExecCommand(environment, "export B")
+	if request.Variables["B"] != "from-env" {
+		t.Errorf("expected the value from the environment but found %q!", request.Variables["B"])
+	}
+
+	request = parseExecCommand(environment, "unset A")
+	if len(request.Names) != 1 || request.Names[0] != "A" {
+		t.Errorf("unexpected names %v", request.Names)
+	}
+
+	request = parseExecCommand(environment, "unseal share")
+	if request.Argument != "share" {
+		t.Errorf("expected argument share but found %q!", request.Argument)
+	}
+}
+
+func TestParseProtocolError(t *testing.T) {
+
+	protocolErr := parseProtocolError([]byte(`{"code":"sealed","message":"server: sealed"}` + "\n"))
+	if protocolErr == nil || protocolErr.Code != ErrorCodeSealed {
+		t.Errorf("expected a sealed error but found %v!", protocolErr)
+	}
+
+	if protocolErr := parseProtocolError([]byte("panic: something else\n")); protocolErr != nil {
+		t.Errorf("parsed %v from invalid data", protocolErr)
+	}
+}
+
+func TestNewProtocolError(t *testing.T) {
+
+	if code := newProtocolError(ErrUnauthorized).Code; code != ErrorCodeUnauthorized {
+		t.Errorf("expected code %s but found %s!", ErrorCodeUnauthorized, code)
+	}
+
+	if code := newProtocolError(ServerError{"backend down"}).Code; code != ErrorCodeInternal {
+		t.Errorf("expected code %s but found %s!", ErrorCodeInternal, code)
+	}
+}
+
+func TestPackMessage(t *testing.T) {
+
+	values, err := UnpackMessage(PackMessage("GROUP", "a=b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 2 || values[0] != "GROUP" || values[1] != "a=b" {
+		t.Errorf("unexpected values %q", values)
+	}
+}
@@ -2,84 +2,391 @@ package auth
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/ssh"
 	"container/list"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/buth/stocker/audit"
 	"github.com/buth/stocker/backend"
 	"github.com/buth/stocker/crypto"
+	"golang.org/x/crypto/ssh"
 	"io"
 	"log"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
 	WriterUser = `w`
 	ReaderUser = `r`
+	AdminUser  = `a`
 )
 
+// keyExtension is the permissions extension used to record the serialized
+// public key a connection authenticated with. For certificates this is the
+// certified key, and principalsExtension records the comma separated list of
+// the certificate's principals.
+const (
+	keyExtension        = `stocker-key`
+	principalsExtension = `stocker-principals`
+)
+
+// validPrincipal reports whether a name can be recorded in the principals
+// extension. SSH certificate principals, gateway token names and gateway
+// certificate common names share the policy's single principal namespace,
+// and a name containing a comma would be read back as several principals.
+func validPrincipal(name string) bool {
+	return !strings.Contains(name, ",")
+}
+
+// identityExtension is the permissions extension used to record the name of
+// the key's owner, if known, and fingerprintExtension records the key's
+// SHA256 fingerprint.
+const (
+	identityExtension    = `stocker-identity`
+	fingerprintExtension = `stocker-fingerprint`
+)
+
+// sourceAddressOption is the certificate critical option restricting the
+// addresses a certificate may be used from.
+const sourceAddressOption = `source-address`
+
 type Server interface {
 	AddReadKey(key ssh.PublicKey)
 	AddWriteKey(key ssh.PublicKey)
+	RemoveReadKey(key ssh.PublicKey)
+	RemoveWriteKey(key ssh.PublicKey)
+	SetReadKeys(keys []ssh.PublicKey)
+	SetWriteKeys(keys []ssh.PublicKey)
+	AddAdminKey(key ssh.PublicKey)
+	SetAdminKeys(keys []ssh.PublicKey)
+	LoadManagedKeys() error
+	SetIdentities(source string, keys []AuthorizedKey)
+	AddUserAuthority(key ssh.PublicKey)
+	SetPolicy(policy *Policy)
+	SetAuditLogger(logger audit.Logger)
+	SetAlgorithms(algorithms *Algorithms) error
+	SetLimits(limits Limits)
 	ListenAndServe(address string) error
+	Serve(listener net.Listener) error
+	ListenAndServeHTTPS(address string, config *GatewayConfig) error
+	ServeHTTPS(listener net.Listener, config *GatewayConfig) error
 	Stop() error
+	Shutdown(timeout time.Duration) error
 }
 
 type server struct {
 	backend backend.Backend
-	crypter crypto.Crypter
+
+	// Key provider. While the server is sealed the provider is nil and shares
+	// are collected until the threshold is reached.
+	provider   crypto.KeyProvider
+	shares     []string
+	threshold  int
+	providerMu sync.RWMutex
+
+	// Group keys. Creating a data key for a group is serialized so that
+	// concurrent writers don't each create one.
+	groupKeysMu sync.Mutex
 
 	// SSH
 	serverConfig *ssh.ServerConfig
+	hostKey      ssh.Signer
 	listeners    *list.List
 	listenersMu  sync.Mutex
 
+	// Connections and sessions in progress. While draining, new sessions are
+	// refused so that the server can shut down once these have finished.
+	conns    *list.List
+	draining bool
+	connsMu  sync.Mutex
+	sessions sync.WaitGroup
+
+	// Connection and authentication limits.
+	limiter *limiter
+
 	// Keys.
 	writeKeys, readKeys     *list.List
 	writeKeysMu, readKeysMu sync.RWMutex
+
+	// Keys authorized to manage reader and writer keys.
+	adminKeys   *list.List
+	adminKeysMu sync.RWMutex
+
+	// Keys added and revoked by administrators, by user. These are kept
+	// apart from the key lists so that they survive the lists being replaced.
+	addedKeys, revokedKeys map[string]*list.List
+	managedKeysMu          sync.RWMutex
+
+	// Names of the owners of keys, keyed by where the names came from and
+	// then by serialized key, so that each source can be replaced.
+	identities   map[string]map[string]string
+	identitiesMu sync.RWMutex
+
+	// Certificate authorities trusted to sign user certificates.
+	certChecker   *ssh.CertChecker
+	authorities   *list.List
+	authoritiesMu sync.RWMutex
+
+	// Policy. If no policy has been set, keys may access every group.
+	policy   *Policy
+	policyMu sync.RWMutex
+
+	// Audit log. If no logger has been set, commands are not audited.
+	auditLogger   audit.Logger
+	auditLoggerMu sync.RWMutex
 }
 
-func NewServer(b backend.Backend, c crypto.Crypter, hostKey ssh.Signer) *server {
+func NewServer(b backend.Backend, p crypto.KeyProvider, hostKey ssh.Signer) *server {
 
-	// Initialize a new server object with the backend and crypter.
+	// Initialize a new server object with the backend and key provider.
 	s := &server{
-		backend: b,
-		crypter: c,
+		backend:  b,
+		provider: p,
 	}
 
-	// Initialize the listener list.
+	// Initialize the listener and connection lists.
 	s.listeners = list.New()
+	s.conns = list.New()
+
+	// Initialize the limiter with the default limits.
+	s.limiter = newLimiter(DefaultLimits)
 
 	// Initialize the key lists.
 	s.writeKeys = list.New()
 	s.readKeys = list.New()
-
-	// Build a new certificate checker.
-	certChecker := &ssh.CertChecker{
-
-		IsAuthority:     NotAnAuthority,
-		UserKeyFallback: s.checkUserKey,
+	s.adminKeys = list.New()
+	s.authorities = list.New()
+
+	// Initialize the managed key lists for each user.
+	s.addedKeys = map[string]*list.List{ReaderUser: list.New(), WriterUser: list.New()}
+	s.revokedKeys = map[string]*list.List{ReaderUser: list.New(), WriterUser: list.New()}
+
+	// Initialize the identities map.
+	s.identities = make(map[string]map[string]string)
+
+	// Build a new certificate checker. Plain keys fall back to the key
+	// lists. The source-address option is checked by checkUserCert.
+	s.certChecker = &ssh.CertChecker{
+		IsUserAuthority:          s.matchUserAuthority,
+		UserKeyFallback:          s.checkUserKey,
+		SupportedCriticalOptions: []string{sourceAddressOption},
 	}
 
 	// An SSH server is represented by a ServerConfig, which holds certificate
-	// details and handles authentication of ServerConns.
+	// details and handles authentication of ServerConns. The default
+	// algorithms can be replaced using SetAlgorithms.
 	s.serverConfig = &ssh.ServerConfig{
 		Config: ssh.Config{
-			Ciphers: []string{"aes256-ctr"},
-			MACs:    []string{"hmac-sha1"},
+			KeyExchanges: DefaultAlgorithms.KeyExchanges,
+			Ciphers:      DefaultAlgorithms.Ciphers,
+			MACs:         DefaultAlgorithms.MACs,
 		},
-		PublicKeyCallback: certChecker.Authenticate,
+		PublicKeyCallback: s.checkUserCert,
 	}
 
 	// Add the signing private key.
+	s.hostKey = hostKey
 	s.serverConfig.AddHostKey(hostKey)
 
 	return s
 }
 
+// NewSealedServer creates a server without a key provider. The server will
+// refuse to encrypt or decrypt values until writers have supplied threshold
+// key shares using the unseal command.
+func NewSealedServer(b backend.Backend, threshold int, hostKey ssh.Signer) *server {
+
+	// Build a server with no key provider.
+	s := NewServer(b, nil, hostKey)
+	s.threshold = threshold
+
+	return s
+}
+
+// getProvider returns the server's key provider, or an error if the server is
+// still sealed.
+func (s *server) getProvider() (crypto.KeyProvider, error) {
+
+	// Get the provider lock for reading.
+	s.providerMu.RLock()
+	defer s.providerMu.RUnlock()
+
+	if s.provider == nil {
+		return nil, ErrSealed
+	}
+
+	return s.provider, nil
+}
+
+// unseal adds a key share to the server. Once the threshold number of shares
+// has been reached the master key is rebuilt from them. It returns the number
+// of shares still required.
+func (s *server) unseal(share string) (int, error) {
+
+	// Get the provider lock for writing.
+	s.providerMu.Lock()
+	defer s.providerMu.Unlock()
+
+	// There is nothing to do if the server has already been unsealed.
+	if s.provider != nil {
+		return 0, nil
+	}
+
+	// Ignore shares that have already been supplied.
+	for _, existing := range s.shares {
+		if existing == share {
+			return s.threshold - len(s.shares), nil
+		}
+	}
+
+	s.shares = append(s.shares, share)
+	if len(s.shares) < s.threshold {
+		return s.threshold - len(s.shares), nil
+	}
+
+	// Discard the shares whether or not they produce a crypter so that a bad
+	// share doesn't prevent a retry.
+	shares := s.shares
+	s.shares = nil
+
+	c, err := crypto.NewCrypterFromShares(shares)
+	if err != nil {
+		return s.threshold, err
+	}
+
+	// Stay sealed unless the rebuilt key opens the data already stored, so
+	// that new data is never written under a wrong key.
+	provider := crypto.NewLocalKeyProvider(c)
+	if err := s.checkProvider(provider); err != nil {
+		return s.threshold, err
+	}
+
+	s.provider = provider
+	return 0, nil
+}
+
+// checkProvider checks that the provider can unwrap a group key already in
+// the backend. Any provider is accepted if there are no group keys yet.
+func (s *server) checkProvider(provider crypto.KeyProvider) error {
+
+	groupKeys, err := s.backend.GetGroupKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, wrapped := range groupKeys {
+		if _, err := provider.UnwrapKey(wrapped); err != nil {
+			return ServerError{"the rebuilt key does not match the stored data; at least one share is wrong"}
+		}
+
+		// One key is enough to tell.
+		return nil
+	}
+
+	return nil
+}
+
+// groupCrypter returns a crypter using the given group's data key, unwrapped
+// by the key provider. Groups written before data keys were introduced have
+// no key and are read using the master key directly, which is only possible
+// when the provider is also a crypter. If create is true, such groups are
+// given a new data key and their values are re-encrypted under it.
+func (s *server) groupCrypter(group string, create bool) (crypto.Crypter, error) {
+
+	// Check that the server has been unsealed.
+	provider, err := s.getProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := s.backend.GetGroupKey(group)
+	if err != nil {
+		return nil, err
+	}
+
+	if wrapped != "" {
+		return crypto.NewCrypterFromWrappedKey(provider, wrapped)
+	}
+
+	// The master key can only be used directly if the provider holds it.
+	master, isCrypter := provider.(crypto.Crypter)
+
+	if !create {
+		if !isCrypter {
+			return nil, ServerError{"no data key for group"}
+		}
+		return master, nil
+	}
+
+	// Get the group keys lock and check again in case another writer created
+	// the key while we were waiting.
+	s.groupKeysMu.Lock()
+	defer s.groupKeysMu.Unlock()
+
+	wrapped, err = s.backend.GetGroupKey(group)
+	if err != nil {
+		return nil, err
+	}
+
+	if wrapped != "" {
+		return crypto.NewCrypterFromWrappedKey(provider, wrapped)
+	}
+
+	// Create and wrap a new data key.
+	key, err := crypto.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err = provider.WrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := crypto.NewCrypterFromWrappedKey(provider, wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	// Re-encrypt any existing values under the data key before saving it.
+	variables, err := s.backend.GetGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(variables) > 0 && !isCrypter {
+		return nil, ServerError{"group has values but no data key"}
+	}
+
+	for variable, cryptedValue := range variables {
+
+		value, err := master.DecryptString(cryptedValue)
+		if err != nil {
+			return nil, err
+		}
+
+		recryptedValue, err := c.EncryptString(value)
+		if err != nil {
+			return nil, err
+		}
+
+		variables[variable] = recryptedValue
+	}
+
+	// Save the key and the re-encrypted values together, so that readers
+	// never see one without the other.
+	if err := s.backend.SetGroupWithKey(group, wrapped, variables); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
 // AddWriteKey adds a public key that is authorized to connect to the server
 // and perform both read and write operations. If the has already been added
 // to the server, this function will update its status.
@@ -96,6 +403,125 @@ func (s *server) AddWriteKey(key ssh.PublicKey) {
 	s.writeKeys.PushBack(serialized)
 }
 
+// RemoveWriteKey revokes a public key's authorization to connect as a writer.
+// It has no effect if the key has not been added.
+func (s *server) RemoveWriteKey(key ssh.PublicKey) {
+
+	// Get the write keys lock for writing.
+	s.writeKeysMu.Lock()
+	defer s.writeKeysMu.Unlock()
+
+	// Remove the key using the generic remove key function.
+	removeKey(key, s.writeKeys)
+}
+
+// SetWriteKeys replaces every writer key at once, so that connections are
+// never checked against a partially updated list.
+func (s *server) SetWriteKeys(keys []ssh.PublicKey) {
+
+	// Build the new list before taking the lock.
+	writeKeys := newKeyList(keys)
+
+	// Get the write keys lock for writing.
+	s.writeKeysMu.Lock()
+	defer s.writeKeysMu.Unlock()
+
+	s.writeKeys = writeKeys
+}
+
+// SetIdentities records the names of the owners of keys, taken from their
+// comments, replacing every name previously recorded from the same source,
+// such as an authorized_keys file. The name is recorded for connections
+// using the key.
+func (s *server) SetIdentities(source string, keys []AuthorizedKey) {
+
+	identities := make(map[string]string)
+	for _, authorizedKey := range keys {
+		if authorizedKey.Comment != "" {
+			identities[SerializeKey(authorizedKey.Key)] = authorizedKey.Comment
+		}
+	}
+
+	// Get the identities lock for writing.
+	s.identitiesMu.Lock()
+	defer s.identitiesMu.Unlock()
+
+	s.identities[source] = identities
+}
+
+// setIdentity records the name of the owner of a single key from the source,
+// or forgets it if the name is empty.
+func (s *server) setIdentity(source string, key ssh.PublicKey, name string) {
+
+	// Get the identities lock for writing.
+	s.identitiesMu.Lock()
+	defer s.identitiesMu.Unlock()
+
+	identities, ok := s.identities[source]
+	if !ok {
+		identities = make(map[string]string)
+		s.identities[source] = identities
+	}
+
+	if name == "" {
+		delete(identities, SerializeKey(key))
+	} else {
+		identities[SerializeKey(key)] = name
+	}
+}
+
+// identity returns the name of the owner of a key, if known. If sources
+// disagree, the name from the first source in sorted order is used.
+func (s *server) identity(key ssh.PublicKey) string {
+
+	// Get the identities lock for reading.
+	s.identitiesMu.RLock()
+	defer s.identitiesMu.RUnlock()
+
+	sources := make([]string, 0, len(s.identities))
+	for source := range s.identities {
+		sources = append(sources, source)
+	}
+
+	sort.Strings(sources)
+
+	serialized := SerializeKey(key)
+	for _, source := range sources {
+		if name := s.identities[source][serialized]; name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// newKeyList returns a list of the serialized keys.
+func newKeyList(keys []ssh.PublicKey) *list.List {
+
+	l := list.New()
+	for _, key := range keys {
+		l.PushBack(SerializeKey(key))
+	}
+
+	return l
+}
+
+func removeKey(key ssh.PublicKey, keys *list.List) {
+
+	// Serialze the key and convert it to an string.
+	serialized := SerializeKey(key)
+
+	// Remove every matching element, saving the next element before each
+	// removal.
+	for e := keys.Front(); e != nil; {
+		next := e.Next()
+		if serialized == e.Value.(string) {
+			keys.Remove(e)
+		}
+		e = next
+	}
+}
+
 func matchKey(key ssh.PublicKey, keys *list.List) bool {
 
 	// Serialze the key and convert it to an string.
@@ -117,8 +543,8 @@ func (s *server) matchWriteKey(key ssh.PublicKey) bool {
 	s.writeKeysMu.RLock()
 	defer s.writeKeysMu.RUnlock()
 
-	// Return the result of the generic match key function.
-	return matchKey(key, s.writeKeys)
+	// Keys added by an administrator are also accepted, unless revoked.
+	return (matchKey(key, s.writeKeys) || s.matchAddedKey(WriterUser, key)) && !s.matchRevokedKey(WriterUser, key)
 }
 
 // AddReaderKey adds a public key that is authorized to connect to the server
@@ -138,72 +564,523 @@ func (s *server) AddReadKey(key ssh.PublicKey) {
 	s.readKeys.PushBack(serialized)
 }
 
+// RemoveReadKey revokes a public key's authorization to connect as a reader.
+// It has no effect if the key has not been added.
+func (s *server) RemoveReadKey(key ssh.PublicKey) {
+
+	// Get the read keys lock for writing.
+	s.readKeysMu.Lock()
+	defer s.readKeysMu.Unlock()
+
+	// Remove the key using the generic remove key function.
+	removeKey(key, s.readKeys)
+}
+
+// SetReadKeys replaces every reader key at once, so that connections are
+// never checked against a partially updated list.
+func (s *server) SetReadKeys(keys []ssh.PublicKey) {
+
+	// Build the new list before taking the lock.
+	readKeys := newKeyList(keys)
+
+	// Get the read keys lock for writing.
+	s.readKeysMu.Lock()
+	defer s.readKeysMu.Unlock()
+
+	s.readKeys = readKeys
+}
+
 func (s *server) matchReadKey(key ssh.PublicKey) bool {
 
 	// Get the read keys lock for reading.
 	s.readKeysMu.RLock()
 	defer s.readKeysMu.RUnlock()
 
-	// Return the result of the generic match key function.
-	return matchKey(key, s.readKeys)
+	// Keys added by an administrator are also accepted, unless revoked.
+	return (matchKey(key, s.readKeys) || s.matchAddedKey(ReaderUser, key)) && !s.matchRevokedKey(ReaderUser, key)
 }
 
 // checkUserKey determines whether or not the given public key is present for
 // the user indicated in the SSH connection meta-data.
 func (s *server) checkUserKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 
-	if u := conn.User(); (u == ReaderUser && s.matchReadKey(key)) || (u == WriterUser && s.matchWriteKey(key)) {
-		return &ssh.Permissions{}, nil
+	if u := conn.User(); (u == ReaderUser && s.matchReadKey(key)) || (u == WriterUser && s.matchWriteKey(key)) || (u == AdminUser && s.matchAdminKey(key)) {
+
+		// Record the key so that the policy can be checked later.
+		return &ssh.Permissions{
+			Extensions: map[string]string{
+				keyExtension:         SerializeKey(key),
+				fingerprintExtension: FingerprintKey(key),
+				identityExtension:    s.identity(key),
+			},
+		}, nil
 	}
 
 	// The default case is to return an error.
 	return nil, errors.New("unauthorized")
 }
 
-func (s *server) exec(stdout io.Writer, canWrite bool, environment map[string]string, commandString string) error {
+// AddUserAuthority adds a certificate authority public key. Certificates it
+// signs are accepted for the reader or writer user if they list that user as
+// a principal and are currently valid.
+func (s *server) AddUserAuthority(key ssh.PublicKey) {
+
+	// Get the authorities lock for writing.
+	s.authoritiesMu.Lock()
+	defer s.authoritiesMu.Unlock()
+
+	// Add the key string to the authorities list.
+	s.authorities.PushBack(SerializeKey(key))
+}
+
+func (s *server) matchUserAuthority(key ssh.PublicKey) bool {
+
+	// Get the authorities lock for reading.
+	s.authoritiesMu.RLock()
+	defer s.authoritiesMu.RUnlock()
+
+	// Return the result of the generic match key function.
+	return matchKey(key, s.authorities)
+}
+
+// checkUserCert authenticates a connection using either a certificate signed
+// by a trusted authority or a key in one of the key lists. The certificate
+// checker verifies the signature and the validity window, and the SSH user
+// must be listed as one of the certificate's principals.
+func (s *server) checkUserCert(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 
-	// Try to pull the group from the environment.
-	var group string
-	if environmentGroup, ok := environment["GROUP"]; ok {
-		group = environmentGroup
+	// Count the attempt against the remote host's limit.
+	if !s.limiter.attempt(remoteHost(conn.RemoteAddr()), time.Now()) {
+		return nil, errors.New("too many authentication attempts")
 	}
 
-	// The first (and only) payload value should be a string.
-	components := strings.SplitN(commandString, ` `, 2)
-	command := components[0]
-	argument := ""
-	if len(components) == 2 {
-		argument = components[1]
+	permissions, err := s.certChecker.Authenticate(conn, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return permissions, nil
+	}
+
+	// Certificates may only be used to connect as the reader or writer user.
+	// Administrators must use a key from the admin keys file, so that a CA
+	// trusted for readers and writers can't also grant key management.
+	if u := conn.User(); u != ReaderUser && u != WriterUser {
+		return nil, errors.New("unauthorized")
+	}
+
+	// The certificate checker accepts a certificate with no principals for
+	// every user, so require the user to be listed explicitly.
+	listed := false
+	for _, principal := range cert.ValidPrincipals {
+		if principal == conn.User() {
+			listed = true
+			break
+		}
+	}
+
+	if !listed {
+		return nil, errors.New("the user is not one of the certificate's principals")
+	}
+
+	// A certified key revoked by an administrator is rejected even though
+	// the certificate is still valid.
+	if s.matchRevokedKey(conn.User(), cert.Key) {
+		return nil, errors.New("revoked")
+	}
+
+	// Principals are recorded as a comma separated list.
+	for _, principal := range cert.ValidPrincipals {
+		if !validPrincipal(principal) {
+			return nil, errors.New("invalid principal")
+		}
+	}
+
+	// Honor the source-address critical option.
+	if addresses, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+		if !matchSourceAddress(addresses, conn.RemoteAddr()) {
+			return nil, errors.New("unauthorized source address")
+		}
+	}
+
+	// Copy the certificate's permissions rather than modifying them, then
+	// record the certified key and principals for the policy.
+	certPermissions := &ssh.Permissions{
+		CriticalOptions: permissions.CriticalOptions,
+		Extensions:      make(map[string]string),
+	}
+
+	for name, value := range permissions.Extensions {
+		certPermissions.Extensions[name] = value
+	}
+
+	certPermissions.Extensions[keyExtension] = SerializeKey(cert.Key)
+	certPermissions.Extensions[principalsExtension] = strings.Join(cert.ValidPrincipals, ",")
+	certPermissions.Extensions[fingerprintExtension] = FingerprintKey(cert.Key)
+	certPermissions.Extensions[identityExtension] = cert.KeyId
+
+	return certPermissions, nil
+}
+
+// SetPolicy sets the policy used to determine which groups each key may read
+// and write. Passing nil allows every key access to every group.
+func (s *server) SetPolicy(policy *Policy) {
+
+	// Get the policy lock for writing.
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+
+	s.policy = policy
+}
+
+// authorize returns an error if the policy doesn't allow the connection to
+// perform the operation on the group.
+func (s *server) authorize(permissions *ssh.Permissions, operation, group string) error {
+
+	// Get the policy lock for reading.
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+
+	if s.policy == nil {
+		return nil
+	}
+
+	if permissions == nil {
+		return ErrUnauthorized
+	}
+
+	// Certificates may carry principals that the policy refers to.
+	var principals []string
+	if principalsString := permissions.Extensions[principalsExtension]; principalsString != "" {
+		principals = strings.Split(principalsString, ",")
+	}
+
+	if !s.policy.Allowed(permissions.Extensions[keyExtension], principals, operation, group) {
+		return ErrUnauthorized
+	}
+
+	return nil
+}
+
+// SetAuditLogger sets the logger that records every command run against the
+// server. Passing nil disables auditing.
+func (s *server) SetAuditLogger(logger audit.Logger) {
+
+	// Get the audit logger lock for writing.
+	s.auditLoggerMu.Lock()
+	defer s.auditLoggerMu.Unlock()
+
+	s.auditLogger = logger
+}
+
+// A caller is an authenticated client on whose behalf requests are handled.
+// SSH connections are callers, as are requests to the HTTPS gateway.
+type caller interface {
+	User() string
+	RemoteAddr() net.Addr
+	permissions() *ssh.Permissions
+}
+
+// sshCaller is the caller for an SSH connection.
+type sshCaller struct {
+	*ssh.ServerConn
+}
+
+func (c sshCaller) permissions() *ssh.Permissions {
+	return c.Permissions
+}
+
+// describeConn identifies an authenticated connection in log messages, such
+// as "w SHA256:nThbg6kX... (alice@example.com) from 192.0.2.1:50000".
+func describeConn(conn *ssh.ServerConn) string {
+	return describeCaller(sshCaller{conn})
+}
+
+// describeCaller identifies a caller in log messages.
+func describeCaller(c caller) string {
+
+	description := c.User()
+	if permissions := c.permissions(); permissions != nil {
+
+		if fingerprint := permissions.Extensions[fingerprintExtension]; fingerprint != "" {
+			description += " " + fingerprint
+		}
+
+		if identity := permissions.Extensions[identityExtension]; identity != "" {
+			description += " (" + identity + ")"
+		}
+	}
+
+	return description + " from " + c.RemoteAddr().String()
+}
+
+// audit records a command in the audit log, if one has been set. Failing to
+// write the log is reported but doesn't affect the command. The key change is
+// only set for key management commands that add or revoke a key.
+func (s *server) audit(conn caller, command, group string, variables []string, keyChange string, err error) {
+
+	// Get the audit logger lock for reading.
+	s.auditLoggerMu.RLock()
+	logger := s.auditLogger
+	s.auditLoggerMu.RUnlock()
+
+	if logger == nil {
+		return
+	}
+
+	event := &audit.Event{
+		Time:       time.Now().UTC(),
+		RemoteAddr: conn.RemoteAddr().String(),
+		User:       conn.User(),
+		Command:    command,
+		Group:      group,
+		Variables:  variables,
+		Result:     audit.ResultOK,
+		KeyChange:  keyChange,
+	}
+
+	if permissions := conn.permissions(); permissions != nil {
+		event.Fingerprint = permissions.Extensions[fingerprintExtension]
+		event.Identity = permissions.Extensions[identityExtension]
+	}
+
+	if err != nil {
+		event.Result = err.Error()
 	}
 
-	switch command {
+	if err := logger.Log(event); err != nil {
+		log.Printf("server: could not write audit log: %s\n", err.Error())
+	}
+}
+
+// handle runs a request on behalf of the caller. Exec commands, the
+// structured protocol and the HTTPS gateway are all handled here.
+func (s *server) handle(canWrite bool, conn caller, request *Request) (response *Response, err error) {
+
+	response = &Response{Version: ProtocolVersion}
+	group := request.Group
+
+	// Record the command once it has finished, including the names of any
+	// variables involved but never their values, or of the key added or
+	// revoked.
+	var variableNames []string
+	var keyChange string
+	defer func() {
+		s.audit(conn, request.Command, group, variableNames, keyChange, err)
+	}()
+
+	// Administrators may only manage keys, and only administrators may manage
+	// keys.
+	if (conn.User() == AdminUser) != (request.Command == "keys") {
+		return nil, ErrUnauthorized
+	}
+
+	switch request.Command {
 	case "env":
 
+		// Check the policy.
+		if err := s.authorize(conn.permissions(), ReadOperation, group); err != nil {
+			return nil, err
+		}
+
 		// Pull the encrypted values from the store.
 		variables, err := s.backend.GetGroup(group)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
+		// There is nothing to decrypt in an empty group.
+		if len(variables) == 0 {
+			break
+		}
+
+		// Get the crypter for the group.
+		crypter, err := s.groupCrypter(group, false)
+		if err != nil {
+			return nil, err
+		}
+
+		// If names were given, return only those variables.
+		if len(request.Names) > 0 {
+			requested := make(map[string]string)
+			for _, variable := range request.Names {
+				if cryptedValue, ok := variables[variable]; ok {
+					requested[variable] = cryptedValue
+				}
+			}
+
+			variables = requested
+		}
+
+		response.Variables = make(map[string]string)
 		for variable, cryptedValue := range variables {
 
 			// Attempt to decrypt the encrypted value.
-			value, err := s.crypter.DecryptString(cryptedValue)
+			value, err := crypter.DecryptString(cryptedValue)
 			if err != nil {
-				return err
+				return nil, err
 			}
 
-			// Write the variable to the channel.
-			fmt.Fprintf(stdout, "%s=%s\n", variable, value)
+			response.Variables[variable] = value
+			variableNames = append(variableNames, variable)
+		}
+
+		sort.Strings(variableNames)
+
+	case "groups":
+
+		// List the groups, leaving out any the policy doesn't allow the
+		// connection to read.
+		groups, err := s.backend.ListGroups()
+		if err != nil {
+			return nil, err
+		}
+
+		response.Groups = make([]string, 0, len(groups))
+		for _, group := range groups {
+			if s.authorize(conn.permissions(), ReadOperation, group) == nil {
+				response.Groups = append(response.Groups, group)
+			}
 		}
 
+		sort.Strings(response.Groups)
+
 	case "export":
 
 		// Check for write permission.
 		if !canWrite {
-			return ServerError{"unauthorized"}
+			return nil, ErrUnauthorized
+		}
+
+		// Check the policy.
+		if err := s.authorize(conn.permissions(), WriteOperation, group); err != nil {
+			return nil, err
+		}
+
+		for variable := range request.Variables {
+			variableNames = append(variableNames, variable)
+		}
+
+		sort.Strings(variableNames)
+
+		// Get the crypter for the group, creating a data key if needed.
+		crypter, err := s.groupCrypter(group, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for variable, value := range request.Variables {
+
+			// Attempt to encrypt the value.
+			cryptedValue, err := crypter.EncryptString(value)
+			if err != nil {
+				return nil, err
+			}
+
+			// Save the encrypted value in the store.
+			if err := s.backend.SetVariable(group, variable, cryptedValue); err != nil {
+				return nil, err
+			}
+		}
+
+	case "unset":
+
+		// Check for write permission.
+		if !canWrite {
+			return nil, ErrUnauthorized
+		}
+
+		// Check the policy.
+		if err := s.authorize(conn.permissions(), WriteOperation, group); err != nil {
+			return nil, err
+		}
+
+		// Remove each of the named variables.
+		variableNames = request.Names
+		for _, variable := range request.Names {
+			if err := s.backend.RemoveVariable(group, variable); err != nil {
+				return nil, err
+			}
+		}
+
+	case "shred":
+
+		// Check for write permission.
+		if !canWrite {
+			return nil, ErrUnauthorized
+		}
+
+		// Check the policy.
+		if err := s.authorize(conn.permissions(), WriteOperation, group); err != nil {
+			return nil, err
+		}
+
+		// Destroy the group's data key first so that its values can never
+		// be decrypted, even if removing them fails.
+		if err := s.backend.RemoveGroupKey(group); err != nil {
+			return nil, err
+		}
+
+		if err := s.backend.RemoveGroup(group); err != nil {
+			return nil, err
+		}
+
+	case "keys":
+
+		// Run the key management subcommand.
+		output := bytes.NewBuffer([]byte{})
+		change, err := s.manageKeys(output, request.Argument)
+		keyChange = change
+		if err != nil {
+			return nil, err
+		}
+
+		response.Output = output.String()
+
+	case "unseal":
+
+		// Check for write permission.
+		if !canWrite {
+			return nil, ErrUnauthorized
+		}
+
+		// Assume the argument is a key share and add it.
+		remaining, err := s.unseal(request.Argument)
+		if err != nil {
+			return nil, err
 		}
 
+		response.Remaining = remaining
+
+	default:
+		return nil, invalidRequest(fmt.Sprintf("unknown command %q", request.Command))
+	}
+
+	return response, nil
+}
+
+// parseExecCommand converts an exec command string into a request. Values
+// for export may be given in the command or taken from the environment.
+func parseExecCommand(environment map[string]string, commandString string) *Request {
+
+	// The command may be followed by a single argument.
+	components := strings.SplitN(commandString, ` `, 2)
+	request := &Request{
+		Version: ProtocolVersion,
+		Command: components[0],
+		Group:   environment["GROUP"],
+	}
+
+	argument := ""
+	if len(components) == 2 {
+		argument = components[1]
+	}
+
+	switch request.Command {
+	case "export":
+
 		// Parse the variable name and value from the argument.
 		argumentComponents := strings.SplitN(argument, `=`, 2)
 		variable := argumentComponents[0]
@@ -216,36 +1093,111 @@ func (s *server) exec(stdout io.Writer, canWrite bool, environment map[string]st
 			value = environmentValue
 		}
 
-		// Attempt to encrypt the value.
-		cryptedValue, err := s.crypter.EncryptString(value)
-		if err != nil {
-			return err
-		}
+		request.Variables = map[string]string{variable: value}
+
+	case "unset":
+
+		// Assume the argument is a variable name.
+		request.Names = []string{argument}
+
+	default:
+		request.Argument = argument
+	}
+
+	return request
+}
+
+func (s *server) exec(stdout io.Writer, canWrite bool, conn *ssh.ServerConn, environment map[string]string, commandString string) error {
+
+	request := parseExecCommand(environment, commandString)
+	response, err := s.handle(canWrite, sshCaller{conn}, request)
+	if err != nil {
+		return err
+	}
+
+	// Write any variables to the channel in the form of an environment.
+	variables := make([]string, 0, len(response.Variables))
+	for variable := range response.Variables {
+		variables = append(variables, variable)
+	}
 
-		// Save the encrypted value in the store.
-		if err := s.backend.SetVariable(group, variable, cryptedValue); err != nil {
+	sort.Strings(variables)
+	for _, variable := range variables {
+		fmt.Fprintf(stdout, "%s=%s\n", variable, response.Variables[variable])
+	}
+
+	// Write any groups one per line.
+	for _, group := range response.Groups {
+		fmt.Fprintln(stdout, group)
+	}
+
+	// Report the number of shares still required after an unseal.
+	if request.Command == "unseal" {
+		fmt.Fprintf(stdout, "%d\n", response.Remaining)
+	}
+
+	fmt.Fprint(stdout, response.Output)
+	return nil
+}
+
+// execKeepSession runs an exec command in a session that is being kept open,
+// writing its output, or the reason it failed, to the channel as a single
+// response message so that the client can tell where each command's output
+// ends.
+func (s *server) execKeepSession(channel ssh.Channel, canWrite bool, conn *ssh.ServerConn, environment map[string]string, commandString string) {
+
+	response := &Response{Version: ProtocolVersion}
+
+	var output bytes.Buffer
+	if err := s.exec(&output, canWrite, conn, environment, commandString); err != nil {
+		log.Printf("server: %s: %s\n", describeConn(conn), err.Error())
+		response.Error = newProtocolError(err)
+	} else {
+		response.Output = output.String()
+	}
+
+	if err := WriteMessage(channel, response); err != nil {
+		log.Printf("server: %s: %s\n", describeConn(conn), err.Error())
+	}
+}
+
+// serveSubsystem handles requests using the structured protocol until the
+// client closes the channel. Each request is answered with a response, and
+// errors are reported in the response rather than ending the session.
+func (s *server) serveSubsystem(channel ssh.Channel, canWrite bool, conn *ssh.ServerConn) error {
+
+	for {
+
+		request := &Request{}
+		if err := ReadMessage(channel, request); err == io.EOF {
+			return nil
+		} else if err != nil {
 			return err
 		}
 
-	case "unset":
-
-		// Check for write permission.
-		if !canWrite {
-			return ServerError{"unauthorized"}
+		var response *Response
+		if request.Version != ProtocolVersion {
+			response = &Response{Version: ProtocolVersion, Error: &ProtocolError{
+				Code:    ErrorCodeUnsupportedVersion,
+				Message: fmt.Sprintf("unsupported protocol version %d", request.Version),
+			}}
+		} else if handled, err := s.handle(canWrite, sshCaller{conn}, request); err != nil {
+			log.Printf("server: %s: %s\n", describeConn(conn), err.Error())
+			response = &Response{Version: ProtocolVersion, Error: newProtocolError(err)}
+		} else {
+			response = handled
 		}
 
-		// Assume the argument is a variable name and remove it.
-		if err := s.backend.RemoveVariable(group, argument); err != nil {
+		if err := WriteMessage(channel, response); err != nil {
 			return err
 		}
 	}
-
-	return nil
 }
 
-func (s *server) handleRequests(channel ssh.Channel, canWrite bool, in <-chan *ssh.Request) {
+func (s *server) handleRequests(channel ssh.Channel, canWrite bool, conn *ssh.ServerConn, in <-chan *ssh.Request) {
 
-	// Close the connection when we return.
+	// Close the connection and mark the session as finished when we return.
+	defer s.sessions.Done()
 	defer channel.Close()
 
 	// Maintain a group state for this channel.
@@ -266,7 +1218,7 @@ func (s *server) handleRequests(channel ssh.Channel, canWrite bool, in <-chan *s
 			if payload, err := UnpackMessage(request.Payload); err != nil {
 
 				// Write the error message to the log.
-				log.Println(err)
+				log.Printf("server: %s: %s\n", describeConn(conn), err.Error())
 			} else {
 
 				// Write the payload slice into the environment map.
@@ -293,14 +1245,27 @@ func (s *server) handleRequests(channel ssh.Channel, canWrite bool, in <-chan *s
 			// Indicate that we have started running the command.
 			request.Reply(true, nil)
 
+			// Clients that asked to keep the session get each command's
+			// result as a response message, and may send more commands.
+			if environment[KeepSessionVariable] == "1" {
+				s.execKeepSession(channel, canWrite, conn, environment, payload[0])
+				continue
+			}
+
 			// The exit status will be reported as a 4-byte, little-endian integer.
 			exitStatusBuffer := bytes.NewBuffer([]byte{})
 
 			// Run the command, reporting any error as a failure.
-			if err := s.exec(channel, canWrite, environment, payload[0]); err != nil {
+			if err := s.exec(channel, canWrite, conn, environment, payload[0]); err != nil {
 
 				// Write the error message to the log.
-				log.Println(err)
+				log.Printf("server: %s: %s\n", describeConn(conn), err.Error())
+
+				// Report the error to the client on stderr as a line of JSON.
+				if message, err := json.Marshal(newProtocolError(err)); err == nil {
+					channel.Stderr().Write(append(message, '\n'))
+				}
+
 				binary.Write(exitStatusBuffer, binary.BigEndian, uint32(1))
 			} else {
 				binary.Write(exitStatusBuffer, binary.BigEndian, uint32(0))
@@ -309,7 +1274,28 @@ func (s *server) handleRequests(channel ssh.Channel, canWrite bool, in <-chan *s
 			// Write the exit status.
 			channel.SendRequest("exit-status", false, exitStatusBuffer.Bytes())
 
-			// Only one exec command can be handled per channel, so we're done.
+			// Ordinary clients wait for the channel to close after the exit
+			// status, so only one exec command is handled.
+			return
+
+		case "subsystem":
+
+			// Only the stocker subsystem is supported.
+			payload, err := UnpackMessage(request.Payload)
+			if err != nil || len(payload) != 1 || payload[0] != SubsystemName {
+				request.Reply(false, nil)
+				return
+			}
+
+			request.Reply(true, nil)
+
+			// Serve requests until the client closes the channel.
+			if err := s.serveSubsystem(channel, canWrite, conn); err != nil {
+				log.Printf("server: %s: %s\n", describeConn(conn), err.Error())
+			}
+
+			// Report success so that clients waiting on the session exit.
+			channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
 			return
 		}
 
@@ -320,7 +1306,7 @@ func (s *server) handleRequests(channel ssh.Channel, canWrite bool, in <-chan *s
 	}
 }
 
-func (s *server) handleChannels(canWrite bool, in <-chan ssh.NewChannel) {
+func (s *server) handleChannels(canWrite bool, conn *ssh.ServerConn, in <-chan ssh.NewChannel) {
 
 	// Pull channels off the incoming channel.
 	for newChannel := range in {
@@ -332,80 +1318,280 @@ func (s *server) handleChannels(canWrite bool, in <-chan ssh.NewChannel) {
 			continue
 		}
 
+		// Refuse new sessions while the server is shutting down.
+		if !s.startSession() {
+			newChannel.Reject(ssh.ResourceShortage, "server is shutting down")
+			continue
+		}
+
 		// Attempt to accecpt the session channel.
 		channel, requests, err := newChannel.Accept()
 		if err != nil {
-			log.Printf("server: could not accept channel: %s\n", err.Error())
+			s.sessions.Done()
+			log.Printf("server: %s: could not accept channel: %s\n", describeConn(conn), err.Error())
 			continue
 		}
 
-		go s.handleRequests(channel, canWrite, requests)
+		go s.handleRequests(channel, canWrite, conn, requests)
 	}
 }
 
-// ListenAndServe starts a new SSH server listening on the given address.
-func (s *server) ListenAndServe(address string) error {
+// SetLimits sets the connection and authentication limits. Connections
+// already established are not affected.
+func (s *server) SetLimits(limits Limits) {
+	s.limiter.setLimits(limits)
+}
 
-	// Get the listeners lock.
-	s.listenersMu.Lock()
+// ListenAndServe starts a new SSH server listening on the given address,
+// which may be a Unix socket in the form accepted by ParseAddress.
+func (s *server) ListenAndServe(address string) error {
 
 	// Start listening.
-	listener, err := net.Listen("tcp", address)
+	listener, err := Listen(address, DefaultSocketMode)
 	if err != nil {
-		s.listenersMu.Unlock()
 		return err
 	}
 
-	// Add the listener to the list and release the lock.
+	return s.Serve(listener)
+}
+
+// addListener records a listener so that Stop can close it.
+func (s *server) addListener(listener net.Listener) {
+
+	// Get the listeners lock and defer its closing.
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+
 	s.listeners.PushBack(listener)
-	s.listenersMu.Unlock()
+}
+
+// Serve accepts SSH connections on the listener, such as one inherited
+// using SystemdListeners. Like ListenAndServe, it returns nil once stopped by
+// Stop.
+func (s *server) Serve(listener net.Listener) error {
+
+	// Add the listener to the list so that it can be stopped.
+	s.addListener(listener)
 
 	for {
 
 		// Accept a new connection.
 		nConn, err := listener.Accept()
 		if err != nil {
+
+			// A listener closed by Stop is not an error.
+			if s.stopped(listener) {
+				return nil
+			}
+
 			return err
 		}
 
-		sConn, chans, reqs, err := ssh.NewServerConn(nConn, s.serverConfig)
-		if err != nil {
-			log.Println("server: failed to handshake")
+		// Refuse connections from banned hosts and any beyond the maximum.
+		host := remoteHost(nConn.RemoteAddr())
+		if !s.limiter.acquire(host, time.Now()) {
+			nConn.Close()
 			continue
 		}
 
-		// Determine whether or not the user can write.
-		canWrite := false
-		if sConn.User() == WriterUser {
-			canWrite = true
+		// Handle the connection without blocking the listener.
+		go s.handleConn(nConn, host)
+	}
+
+	return nil
+}
+
+// handleConn performs the SSH handshake and services the connection until
+// it closes.
+func (s *server) handleConn(nConn net.Conn, host string) {
+
+	// Release the connection when it closes.
+	defer s.limiter.release()
+
+	// Limit the time allowed to complete the handshake.
+	if timeout := s.limiter.handshakeTimeout(); timeout > 0 {
+		nConn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	// Note whether a key was rejected during the handshake. Only handshakes
+	// that fail after a rejection count against the host, so that health
+	// checks and scanners that never try to authenticate aren't banned.
+	rejected := false
+	config := *s.serverConfig
+	config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		permissions, err := s.checkUserCert(conn, key)
+		if err != nil {
+			rejected = true
+		}
+
+		return permissions, err
+	}
+
+	sConn, chans, reqs, err := ssh.NewServerConn(nConn, &config)
+	if err != nil {
+		nConn.Close()
+		// Unix socket peers have no host to name them by.
+		peer := host
+		if peer == "" {
+			peer = "a Unix socket peer"
 		}
 
-		// The incoming Request channel must be serviced.
-		go ssh.DiscardRequests(reqs)
+		log.Printf("server: failed to handshake with %s: %s\n", peer, err.Error())
 
-		// Service the incoming Channel channel.
-		go s.handleChannels(canWrite, chans)
+		// Ban the host if it has failed to authenticate too many times.
+		if rejected && s.limiter.fail(host, time.Now()) {
+			log.Printf("server: banned %s after repeated failures\n", host)
+		}
+
+		return
 	}
 
-	return nil
+	// Clear the deadline now that the handshake is complete.
+	nConn.SetDeadline(time.Time{})
+	s.limiter.succeed(host)
+
+	log.Printf("server: %s connected\n", describeConn(sConn))
+
+	// Track the connection so that it can be closed on shutdown.
+	element, ok := s.addConn(sConn)
+	if !ok {
+		sConn.Close()
+		return
+	}
+	defer s.removeConn(element)
+
+	// Determine whether or not the user can write.
+	canWrite := false
+	if sConn.User() == WriterUser {
+		canWrite = true
+	}
+
+	// The incoming Request channel must be serviced.
+	go ssh.DiscardRequests(reqs)
+
+	// Service the incoming Channel channel until the connection closes.
+	s.handleChannels(canWrite, sConn, chans)
 }
 
-func (s *server) Stop() error {
+// stopped reports whether the listener has been closed by Stop.
+func (s *server) stopped(listener net.Listener) bool {
 
 	// Get the listeners lock and defer its closing.
 	s.listenersMu.Lock()
 	defer s.listenersMu.Unlock()
 
 	for e := s.listeners.Front(); e != nil; e = e.Next() {
+		if e.Value.(net.Listener) == listener {
+			return false
+		}
+	}
 
-		if err := e.Value.(net.Listener).Close(); err != nil {
-			return err
+	return true
+}
+
+// Stop closes every listener so that no new connections are accepted.
+// Connections already established are not affected. It is safe to call
+// concurrently with ListenAndServe, which will return nil.
+func (s *server) Stop() error {
+
+	// Swap out the listener list while holding the lock, then close the
+	// listeners without it.
+	s.listenersMu.Lock()
+	listeners := s.listeners
+	s.listeners = list.New()
+	s.listenersMu.Unlock()
+
+	// Close every listener, returning the first error.
+	var err error
+	for e := listeners.Front(); e != nil; e = e.Next() {
+		if closeErr := e.Value.(net.Listener).Close(); closeErr != nil && err == nil {
+			err = closeErr
 		}
+	}
 
-		s.listeners.Remove(e)
+	return err
+}
+
+// addConn records an established connection. It returns false if the server
+// is shutting down, in which case the connection should be closed.
+func (s *server) addConn(conn *ssh.ServerConn) (*list.Element, bool) {
+
+	// Get the connections lock and defer its closing.
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.draining {
+		return nil, false
 	}
 
-	return nil
+	return s.conns.PushBack(conn), true
+}
+
+// removeConn removes a connection recorded by addConn.
+func (s *server) removeConn(element *list.Element) {
+
+	// Get the connections lock and defer its closing.
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	s.conns.Remove(element)
+}
+
+// startSession counts a new session. It returns false if the server is
+// shutting down. Sessions are counted while holding the connections lock so
+// that none can start once Shutdown has begun waiting.
+func (s *server) startSession() bool {
+
+	// Get the connections lock and defer its closing.
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.draining {
+		return false
+	}
+
+	s.sessions.Add(1)
+	return true
+}
+
+// Shutdown stops accepting connections and waits up to timeout for sessions
+// in progress to finish before closing every connection.
+func (s *server) Shutdown(timeout time.Duration) error {
+
+	// Stop accepting new connections.
+	err := s.Stop()
+
+	// Refuse new sessions.
+	s.connsMu.Lock()
+	s.draining = true
+	s.connsMu.Unlock()
+
+	// Wait for the sessions in progress to finish, up to the timeout.
+	drained := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Println("server: timed out waiting for sessions to finish")
+	}
+
+	// Close every connection. Their handlers remove them from the list.
+	s.connsMu.Lock()
+	conns := make([]*ssh.ServerConn, 0, s.conns.Len())
+	for e := s.conns.Front(); e != nil; e = e.Next() {
+		conns = append(conns, e.Value.(*ssh.ServerConn))
+	}
+	s.connsMu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	return err
 }
 
 type ServerError struct {
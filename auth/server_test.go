@@ -1,10 +1,15 @@
 package auth
 
 import (
-	"code.google.com/p/go.crypto/ssh"
+	"bytes"
+	"crypto/rand"
+	"fmt"
 	"github.com/buth/stocker/backend/redis"
 	"github.com/buth/stocker/crypto"
+	"golang.org/x/crypto/ssh"
+	"net"
 	"testing"
+	"time"
 )
 
 var ServerTestPublicKeys = [][]byte{
@@ -69,23 +74,50 @@ yBG6+cSbZJJzZ3x4AT2xDNQxz+tEzHdnlaUGxKeEzh5WZzEKmKrDVSKjSA9PLw==
 -----END RSA PRIVATE KEY-----
 `)
 
+// serverTestKey is the master key of every test server. Group keys are
+// stored in the shared "test" namespace, so each server must be able to
+// unwrap the keys left behind by the servers before it, in this run or an
+// earlier one.
+var serverTestKey = bytes.Repeat([]byte{0x5a}, crypto.KeyLength)
+
 func newTestServer() (Server, error) {
 
 	// Create a new backend object.
 	b := redis.New("test", "tcp", "127.0.0.1:6379")
 
-	// Create a new crypter.
-	c, err := crypto.NewRandomCrypter()
+	// Create a crypter using the fixed test key.
+	c, err := crypto.NewCrypter(bytes.NewReader(serverTestKey))
 	if err != nil {
 		return nil, err
 	}
 
+	// Remove any group, and its key, left behind under another master key,
+	// since the test server could never decrypt it.
+	wrappedKeys, err := b.GetGroupKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	for group, wrapped := range wrappedKeys {
+		if _, err := crypto.UnwrapKey(c, wrapped); err == nil {
+			continue
+		}
+
+		if err := b.RemoveGroupKey(group); err != nil {
+			return nil, err
+		}
+
+		if err := b.RemoveGroup(group); err != nil {
+			return nil, err
+		}
+	}
+
 	private, _ := ssh.ParsePrivateKey(ServerTestPrivateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	s := NewServer(b, c, private)
+	s := NewServer(b, crypto.NewLocalKeyProvider(c), private)
 
 	for _, publicKey := range ServerTestPublicKeys {
 		publicKeyParsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
@@ -112,3 +144,354 @@ func TestServer(t *testing.T) {
 	server.Stop()
 
 }
+
+func TestServerUnseal(t *testing.T) {
+
+	c, err := crypto.NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := c.Split(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	private, err := ssh.ParsePrivateKey(ServerTestPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a namespace of our own so that no group keys exist yet.
+	namespace := fmt.Sprintf("test-unseal-%d", time.Now().UnixNano())
+	s := NewSealedServer(redis.New(namespace, "tcp", "127.0.0.1:6379"), 2, private)
+
+	if _, err := s.getProvider(); err == nil {
+		t.Error("sealed server returned a key provider")
+	}
+
+	if remaining, err := s.unseal(shares[0]); err != nil {
+		t.Fatal(err)
+	} else if remaining != 1 {
+		t.Errorf("expected 1 remaining share but found %d!", remaining)
+	}
+
+	if remaining, err := s.unseal(shares[2]); err != nil {
+		t.Fatal(err)
+	} else if remaining != 0 {
+		t.Errorf("expected 0 remaining shares but found %d!", remaining)
+	}
+
+	if _, err := s.getProvider(); err != nil {
+		t.Error(err)
+	}
+
+	// Create a group key wrapped under the master key.
+	if _, err := s.groupCrypter("unseal", true); err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.backend.RemoveGroupKey("unseal")
+
+	// Shares of a different key should leave the server sealed.
+	other, err := crypto.NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherShares, err := other.Split(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewSealedServer(redis.New(namespace, "tcp", "127.0.0.1:6379"), 2, private)
+	s.unseal(otherShares[0])
+	if _, err := s.unseal(otherShares[1]); err == nil {
+		t.Error("unsealed with the wrong key")
+	}
+
+	if _, err := s.getProvider(); err == nil {
+		t.Error("server unsealed with the wrong key returned a key provider")
+	}
+}
+
+func TestServerKeys(t *testing.T) {
+
+	private, err := ssh.ParsePrivateKey(ServerTestPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(redis.New("test", "tcp", "127.0.0.1:6379"), nil, private)
+
+	var keys []ssh.PublicKey
+	for _, publicKey := range ServerTestPublicKeys {
+		publicKeyParsed, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, publicKeyParsed)
+	}
+
+	s.SetReadKeys(keys[:2])
+	s.AddWriteKey(keys[2])
+
+	if !s.matchReadKey(keys[0]) || !s.matchReadKey(keys[1]) || s.matchReadKey(keys[2]) {
+		t.Error("read keys were not set")
+	}
+
+	s.RemoveReadKey(keys[0])
+	s.RemoveWriteKey(keys[2])
+
+	if s.matchReadKey(keys[0]) || !s.matchReadKey(keys[1]) {
+		t.Error("read key was not removed")
+	}
+
+	if s.matchWriteKey(keys[2]) {
+		t.Error("write key was not removed")
+	}
+
+	// Replacing the keys should drop any that are no longer present.
+	s.SetReadKeys(keys[2:])
+
+	if s.matchReadKey(keys[1]) || !s.matchReadKey(keys[2]) {
+		t.Error("read keys were not replaced")
+	}
+}
+
+func TestServerManagedKeys(t *testing.T) {
+
+	private, err := ssh.ParsePrivateKey(ServerTestPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := redis.New("test", "tcp", "127.0.0.1:6379")
+	s := NewServer(b, nil, private)
+
+	key, comment, _, _, err := ssh.ParseAuthorizedKey(ServerTestPublicKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Revocation should apply to keys from any source.
+	s.AddReadKey(key)
+	if err := s.revokeManagedKey(ReaderUser, key, comment); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.matchReadKey(key) {
+		t.Error("revoked key was accepted")
+	}
+
+	// Replacing the configured keys shouldn't drop an added key.
+	if err := s.addManagedKey(ReaderUser, key, comment); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SetReadKeys(nil)
+	if !s.matchReadKey(key) {
+		t.Error("added key was not accepted")
+	}
+
+	if s.matchWriteKey(key) {
+		t.Error("added reader key was accepted for the writer")
+	}
+
+	// The added key should be loaded by a new server using the backend.
+	loaded := NewServer(b, nil, private)
+	if err := loaded.LoadManagedKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.matchReadKey(key) {
+		t.Error("added key was not loaded")
+	}
+
+	if err := b.RemoveFromKeyList(ReaderUser, authorizedKeyString(key)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serverTestConn is the connection metadata of a client authenticating as a
+// given user.
+type serverTestConn struct {
+	user string
+}
+
+func (c serverTestConn) User() string          { return c.user }
+func (c serverTestConn) SessionID() []byte     { return nil }
+func (c serverTestConn) ClientVersion() []byte { return nil }
+func (c serverTestConn) ServerVersion() []byte { return nil }
+func (c serverTestConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+}
+func (c serverTestConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 2022}
+}
+
+func TestServerKeyIdentity(t *testing.T) {
+
+	private, err := ssh.ParsePrivateKey(ServerTestPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(redis.New("test", "tcp", "127.0.0.1:6379"), nil, private)
+
+	key, comment, _, _, err := ssh.ParseAuthorizedKey(ServerTestPublicKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.AddReadKey(key)
+	s.SetIdentities("test", []AuthorizedKey{{key, comment}})
+
+	permissions, err := s.checkUserKey(serverTestConn{ReaderUser}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fingerprint := permissions.Extensions[fingerprintExtension]; fingerprint != FingerprintKey(key) {
+		t.Errorf("expected fingerprint %s but found %s!", FingerprintKey(key), fingerprint)
+	}
+
+	if identity := permissions.Extensions[identityExtension]; identity != comment {
+		t.Errorf("expected identity %s but found %s!", comment, identity)
+	}
+
+	if _, err := s.checkUserKey(serverTestConn{WriterUser}, key); err == nil {
+		t.Error("reader key was accepted for the writer")
+	}
+}
+
+// serverTestCertificate returns a user certificate for key signed by the
+// authority, valid for principals until validBefore.
+func serverTestCertificate(t *testing.T, authority ssh.Signer, key ssh.PublicKey, principals []string, validBefore uint64, criticalOptions map[string]string) *ssh.Certificate {
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidBefore:     validBefore,
+		Permissions:     ssh.Permissions{CriticalOptions: criticalOptions},
+	}
+
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+func TestServerUserCertificates(t *testing.T) {
+
+	authority, err := ssh.ParsePrivateKey(ServerTestPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.ParsePrivateKey(ClientTestPrivateKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := signer.PublicKey()
+
+	b := redis.New("test", "tcp", "127.0.0.1:6379")
+	s := NewServer(b, nil, authority)
+	s.AddUserAuthority(authority.PublicKey())
+
+	valid := serverTestCertificate(t, authority, key, []string{ReaderUser, "deploy"}, ssh.CertTimeInfinity, nil)
+	permissions, err := s.checkUserCert(serverTestConn{ReaderUser}, valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if principals := permissions.Extensions[principalsExtension]; principals != "r,deploy" {
+		t.Errorf("expected principals r,deploy but found %s!", principals)
+	}
+
+	if _, err := s.checkUserCert(serverTestConn{WriterUser}, valid); err == nil {
+		t.Error("certificate was accepted for a user it doesn't list")
+	}
+
+	// The certificate checker would accept this for every user.
+	unlisted := serverTestCertificate(t, authority, key, nil, ssh.CertTimeInfinity, nil)
+	if _, err := s.checkUserCert(serverTestConn{WriterUser}, unlisted); err == nil {
+		t.Error("certificate without principals was accepted")
+	}
+
+	expired := serverTestCertificate(t, authority, key, []string{ReaderUser}, uint64(time.Now().Add(-time.Hour).Unix()), nil)
+	if _, err := s.checkUserCert(serverTestConn{ReaderUser}, expired); err == nil {
+		t.Error("expired certificate was accepted")
+	}
+
+	// The test connection comes from 192.0.2.1.
+	elsewhere := serverTestCertificate(t, authority, key, []string{ReaderUser}, ssh.CertTimeInfinity, map[string]string{sourceAddressOption: "198.51.100.0/24"})
+	if _, err := s.checkUserCert(serverTestConn{ReaderUser}, elsewhere); err == nil {
+		t.Error("certificate was accepted from outside its source addresses")
+	}
+
+	here := serverTestCertificate(t, authority, key, []string{ReaderUser}, ssh.CertTimeInfinity, map[string]string{sourceAddressOption: "192.0.2.0/24"})
+	if _, err := s.checkUserCert(serverTestConn{ReaderUser}, here); err != nil {
+		t.Error(err)
+	}
+
+	admin := serverTestCertificate(t, authority, key, []string{AdminUser}, ssh.CertTimeInfinity, nil)
+	if _, err := s.checkUserCert(serverTestConn{AdminUser}, admin); err == nil {
+		t.Error("certificate was accepted for the admin user")
+	}
+
+	// Revoking the certified key should reject the certificate.
+	if err := s.revokeManagedKey(ReaderUser, key, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer b.RemoveFromKeyList(ReaderUser+revokedSuffix, authorizedKeyString(key))
+
+	if _, err := s.checkUserCert(serverTestConn{ReaderUser}, valid); err == nil {
+		t.Error("certificate for a revoked key was accepted")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+
+	server, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listening := make(chan error, 1)
+	go func() {
+		listening <- server.ListenAndServe(`:2023`)
+	}()
+
+	// Wait for the server to start listening.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", ":2023")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stopping concurrently with shutting down should be safe.
+	go server.Stop()
+	if err := server.Shutdown(time.Second); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case err := <-listening:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("server did not stop listening")
+	}
+}
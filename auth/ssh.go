@@ -2,9 +2,12 @@ package auth
 
 import (
 	"bytes"
-	"code.google.com/p/go.crypto/ssh"
 	"container/list"
 	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strings"
 )
 
 func UnpackMessage(message []byte) ([]string, error) {
@@ -41,6 +44,53 @@ func UnpackMessage(message []byte) ([]string, error) {
 	return rval, nil
 }
 
+// PackMessage is the inverse of UnpackMessage, encoding each string prefixed
+// by its length as a 4-byte, big-endian integer.
+func PackMessage(values ...string) []byte {
+
+	buf := bytes.NewBuffer([]byte{})
+	for _, value := range values {
+		binary.Write(buf, binary.BigEndian, uint32(len(value)))
+		buf.WriteString(value)
+	}
+
+	return buf.Bytes()
+}
+
+// An AuthorizedKey is a public key parsed from an authorized_keys file along
+// with its comment, which is used as the name of the key's owner.
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+}
+
+// ParseAuthorizedKeys parses every key in data, which is expected to be in the
+// OpenSSH authorized_keys format. Blank lines and comment lines are skipped.
+// Options such as from= and restrict are not supported, and a key with any
+// options is rejected rather than trusted without them.
+func ParseAuthorizedKeys(data []byte) ([]AuthorizedKey, error) {
+
+	authorizedKeys := make([]AuthorizedKey, 0)
+
+	// Parse keys until there is nothing left but whitespace.
+	for len(bytes.TrimSpace(data)) > 0 {
+
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return authorizedKeys, err
+		}
+
+		if len(options) > 0 {
+			return authorizedKeys, ServerError{fmt.Sprintf("authorized_keys options are not supported: %s", strings.Join(options, ","))}
+		}
+
+		authorizedKeys = append(authorizedKeys, AuthorizedKey{key, comment})
+		data = rest
+	}
+
+	return authorizedKeys, nil
+}
+
 func SerializeKey(key ssh.PublicKey) string {
 	return string(key.Marshal())
 }
@@ -49,3 +99,33 @@ func SerializeKey(key ssh.PublicKey) string {
 // in order to indicate that we are not accepting any certificate as an
 // authority.
 func NotAnAuthority(auth ssh.PublicKey) bool { return false }
+
+// matchSourceAddress reports whether the remote address is within one of the
+// comma separated addresses or CIDR blocks of a certificate's source-address
+// critical option.
+func matchSourceAddress(addresses string, remote net.Addr) bool {
+
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, address := range strings.Split(addresses, ",") {
+
+		address = strings.TrimSpace(address)
+
+		// Plain addresses are treated as single-address blocks.
+		if !strings.Contains(address, "/") {
+			if ip := net.ParseIP(address); ip != nil && ip.Equal(tcpAddr.IP) {
+				return true
+			}
+			continue
+		}
+
+		if _, network, err := net.ParseCIDR(address); err == nil && network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
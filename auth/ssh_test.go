@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+
+	// Build an authorized_keys file with a comment line and a blank line.
+	data := bytes.NewBufferString("# readers\n\n")
+	for _, publicKey := range ServerTestPublicKeys {
+		data.Write(publicKey)
+	}
+
+	authorizedKeys, err := ParseAuthorizedKeys(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(authorizedKeys) != len(ServerTestPublicKeys) {
+		t.Fatalf("expected %d keys but found %d!", len(ServerTestPublicKeys), len(authorizedKeys))
+	}
+
+	for i, authorizedKey := range authorizedKeys {
+		if expected := []string{"key1", "key2", "key3"}[i]; authorizedKey.Comment != expected {
+			t.Errorf("expected comment %s but found %s!", expected, authorizedKey.Comment)
+		}
+	}
+}
+
+func TestParseAuthorizedKeysOptions(t *testing.T) {
+
+	data := append([]byte(`from="10.0.0.0/8" `), ServerTestPublicKeys[0]...)
+	if _, err := ParseAuthorizedKeys(data); err == nil {
+		t.Fatal("expected a key with options to be rejected!")
+	}
+}
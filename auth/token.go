@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// A Token grants access to the HTTPS gateway as the reader or writer user. It
+// is signed with a secret shared by the server and whoever issues tokens.
+type Token struct {
+
+	// User is either ReaderUser or WriterUser.
+	User string `json:"user"`
+
+	// Name identifies the token's holder. It is logged and matched against
+	// the principals in the policy, so it may not contain a comma.
+	Name string `json:"name"`
+
+	// Expires is the time, in seconds since the Unix epoch, after which the
+	// token is no longer accepted. Zero means the token never expires.
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// SignToken encodes the token and signs it with the secret. The result is
+// the base64 encoded token and signature joined by a period.
+func SignToken(secret []byte, token *Token) (string, error) {
+
+	if token.User != ReaderUser && token.User != WriterUser {
+		return "", ServerError{"tokens must be for the reader or writer user"}
+	}
+
+	if !validPrincipal(token.Name) {
+		return "", ServerError{"token names may not contain a comma"}
+	}
+
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	signature := base64.RawURLEncoding.EncodeToString(signToken(secret, encodedPayload))
+
+	return encodedPayload + "." + signature, nil
+}
+
+// VerifyToken checks the signature and expiry of a token created by
+// SignToken and returns the token. Any problem is reported as
+// ErrUnauthorized.
+func VerifyToken(secret []byte, tokenString string, now time.Time) (*Token, error) {
+
+	components := strings.Split(tokenString, ".")
+	if len(components) != 2 {
+		return nil, ErrUnauthorized
+	}
+
+	// Check the signature before looking at the payload.
+	signature, err := base64.RawURLEncoding.DecodeString(components[1])
+	if err != nil || !hmac.Equal(signature, signToken(secret, components[0])) {
+		return nil, ErrUnauthorized
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(components[0])
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	token := &Token{}
+	if err := json.Unmarshal(payload, token); err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	if token.User != ReaderUser && token.User != WriterUser {
+		return nil, ErrUnauthorized
+	}
+
+	if token.Expires != 0 && now.Unix() >= token.Expires {
+		return nil, ErrUnauthorized
+	}
+
+	return token, nil
+}
+
+// signToken computes the HMAC-SHA256 of the encoded payload.
+func signToken(secret []byte, encodedPayload string) []byte {
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encodedPayload))
+
+	return mac.Sum(nil)
+}
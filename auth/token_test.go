@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+
+	secret := []byte("secret")
+	now := time.Unix(1000, 0)
+
+	tokenString, err := SignToken(secret, &Token{User: WriterUser, Name: "deploy", Expires: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token, err := VerifyToken(secret, tokenString, now); err != nil {
+		t.Error(err)
+	} else if token.User != WriterUser || token.Name != "deploy" {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	if _, err := VerifyToken([]byte("other"), tokenString, now); err != ErrUnauthorized {
+		t.Error("token verified with the wrong secret")
+	}
+
+	if _, err := VerifyToken(secret, tokenString, time.Unix(2000, 0)); err != ErrUnauthorized {
+		t.Error("expired token verified")
+	}
+
+	// Changing the payload should invalidate the signature.
+	if _, err := VerifyToken(secret, "e30"+tokenString[3:], now); err != ErrUnauthorized {
+		t.Error("modified token verified")
+	}
+
+	for _, malformed := range []string{"", "abc", "a.b.c", "."} {
+		if _, err := VerifyToken(secret, malformed, now); err != ErrUnauthorized {
+			t.Errorf("malformed token %q verified", malformed)
+		}
+	}
+
+	if _, err := SignToken(secret, &Token{User: AdminUser}); err == nil {
+		t.Error("signed a token for the admin user")
+	}
+
+	if _, err := SignToken(secret, &Token{User: ReaderUser, Name: "deploy,admin"}); err == nil {
+		t.Error("signed a token with a comma in its name")
+	}
+}
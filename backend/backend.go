@@ -11,6 +11,28 @@ type Backend interface {
 	RemoveVariable(group, variable string) error
 	GetGroup(group string) (map[string]string, error)
 	RemoveGroup(group string) error
+	ListGroups() ([]string, error)
+
+	// Group keys are stored separately from variables. GetGroupKey returns an
+	// empty string if no key has been set for the group.
+	GetGroupKey(group string) (string, error)
+	SetGroupKey(group, key string) error
+	RemoveGroupKey(group string) error
+	GetGroupKeys() (map[string]string, error)
+
+	// SetGroupWithKey sets the group's key and the given variables
+	// atomically, so that no reader sees values encrypted under a key that
+	// hasn't been stored, or the key alongside values it can't decrypt.
+	SetGroupWithKey(group, key string, variables map[string]string) error
+
+	// Key lists map public keys to comments. They hold the keys managed by
+	// administrators.
+	GetKeyList(name string) (map[string]string, error)
+	AddToKeyList(name, key, comment string) error
+	RemoveFromKeyList(name, key string) error
+
+	// Close releases any resources held by the backend.
+	Close() error
 }
 
 func NewBackend(kind, namespace, protocol, address string) (Backend, error) {
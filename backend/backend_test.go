@@ -78,3 +78,100 @@ func TestBackendGetAll(t *testing.T) {
 		}
 	}
 }
+
+func TestBackendGroupKeys(t *testing.T) {
+	for _, b := range testBackends {
+
+		backend, err := NewBackend(b.Kind, b.Namespace, b.Protocol, b.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if key, err := backend.GetGroupKey("testgroup"); err != nil {
+			t.Error(err)
+		} else if key != "" {
+			t.Errorf("expected no key but found %s!", key)
+		}
+
+		if err := backend.SetGroupKey("testgroup", "TESTKEY"); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := backend.GetGroupKeys()
+		if err != nil {
+			t.Error(err)
+		} else if keys["testgroup"] != "TESTKEY" {
+			t.Errorf("expected key TESTKEY but found %s!", keys["testgroup"])
+		}
+
+		if err := backend.RemoveGroupKey("testgroup"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackendListGroups(t *testing.T) {
+	for _, b := range testBackends {
+
+		backend, err := NewBackend(b.Kind, b.Namespace, b.Protocol, b.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := backend.SetVariable("testgroup", "TESTVARIABLE1", "TESTVALUE1"); err != nil {
+			t.Fatal(err)
+		}
+
+		groups, err := backend.ListGroups()
+		if err != nil {
+			t.Error(err)
+		}
+
+		found := false
+		for _, group := range groups {
+			if group == "testgroup" {
+				found = true
+			}
+		}
+
+		if !found {
+			t.Errorf("testgroup not found in %v!", groups)
+		}
+
+		if err := backend.RemoveGroup("testgroup"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackendKeyLists(t *testing.T) {
+	for _, b := range testBackends {
+
+		backend, err := NewBackend(b.Kind, b.Namespace, b.Protocol, b.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := backend.AddToKeyList("testlist", "TESTKEY", "TESTCOMMENT"); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := backend.GetKeyList("testlist")
+		if err != nil {
+			t.Error(err)
+		} else if keys["TESTKEY"] != "TESTCOMMENT" {
+			t.Errorf("expected comment TESTCOMMENT but found %s!", keys["TESTKEY"])
+		}
+
+		if err := backend.RemoveFromKeyList("testlist", "TESTKEY"); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err = backend.GetKeyList("testlist")
+		if err != nil {
+			t.Error(err)
+		} else if _, ok := keys["TESTKEY"]; ok {
+			t.Error("key was not removed!")
+		}
+	}
+}
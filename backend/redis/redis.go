@@ -2,13 +2,17 @@ package redis
 
 import (
 	"bytes"
+	"errors"
 	"github.com/garyburd/redigo/redis"
 	"log"
+	"strings"
 )
 
 const (
-	MaxIdle int = 2
-	KeySep      = ':'
+	MaxIdle       int = 2
+	KeySep            = ':'
+	KeysSuffix        = ".keys"
+	KeyListSuffix     = ".keylist."
 )
 
 type redisBackend struct {
@@ -44,6 +48,59 @@ func (r *redisBackend) Key(group string) []byte {
 	return buf.Bytes()
 }
 
+func (r *redisBackend) ListGroups() ([]string, error) {
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Every group is stored under the namespace prefix.
+	prefix := string(r.Key(""))
+	groups := make([]string, 0)
+
+	// Iterate with SCAN rather than KEYS so as not to block the server.
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", prefix+"*"))
+		if err != nil {
+			return groups, err
+		}
+
+		if len(reply) != 2 {
+			return groups, errors.New("redis: unexpected reply to SCAN")
+		}
+
+		if cursor, err = redis.Int(reply[0], nil); err != nil {
+			return groups, err
+		}
+
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return groups, err
+		}
+
+		for _, key := range keys {
+			groups = append(groups, strings.TrimPrefix(key, prefix))
+		}
+
+		if cursor == 0 {
+			return groups, nil
+		}
+	}
+}
+
+// keysKey returns the key of the hash holding group keys. It can't collide
+// with a group key because it doesn't contain the separator.
+func (r *redisBackend) keysKey() string {
+	return r.namespace + KeysSuffix
+}
+
+// keyListKey returns the key of the hash holding the named key list. Like
+// keysKey, it can't collide with a group key.
+func (r *redisBackend) keyListKey(name string) string {
+	return r.namespace + KeyListSuffix + name
+}
+
 func (r *redisBackend) GetVariable(group, variable string) (string, error) {
 
 	// Get a connection from the pool and defer its closing.
@@ -110,3 +167,147 @@ func (r *redisBackend) RemoveGroup(group string) error {
 	_, err := conn.Do("DEL", r.Key(group))
 	return err
 }
+
+func (r *redisBackend) GetGroupKey(group string) (string, error) {
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// A missing key is not an error.
+	key, err := redis.String(conn.Do("HGET", r.keysKey(), group))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return key, err
+}
+
+func (r *redisBackend) SetGroupKey(group, key string) error {
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Run the SET command and return any error.
+	_, err := conn.Do("HMSET", r.keysKey(), group, key)
+	return err
+}
+
+func (r *redisBackend) RemoveGroupKey(group string) error {
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Run the DEL command and return any error.
+	_, err := conn.Do("HDEL", r.keysKey(), group)
+	return err
+}
+
+func (r *redisBackend) GetGroupKeys() (map[string]string, error) {
+
+	// Create an empty map.
+	keys := make(map[string]string)
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Get the keys as a flat string.
+	values, err := redis.Strings(conn.Do("HGETALL", r.keysKey()))
+	if err != nil {
+		return keys, err
+	}
+
+	// Write the values into the keys map.
+	for i := 0; i < len(values)-1; i += 2 {
+		keys[values[i]] = values[i+1]
+	}
+
+	// Return the map with no error.
+	return keys, nil
+}
+
+func (r *redisBackend) SetGroupWithKey(group, key string, variables map[string]string) error {
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Queue the commands in a transaction so that they are applied together.
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+
+	if len(variables) > 0 {
+		args := []interface{}{r.Key(group)}
+		for variable, value := range variables {
+			args = append(args, variable, value)
+		}
+
+		if err := conn.Send("HMSET", args...); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Send("HMSET", r.keysKey(), group, key); err != nil {
+		return err
+	}
+
+	// Run the transaction and return any error.
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (r *redisBackend) GetKeyList(name string) (map[string]string, error) {
+
+	// Create an empty map.
+	keys := make(map[string]string)
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Get the keys as a flat string.
+	values, err := redis.Strings(conn.Do("HGETALL", r.keyListKey(name)))
+	if err != nil {
+		return keys, err
+	}
+
+	// Write the values into the keys map.
+	for i := 0; i < len(values)-1; i += 2 {
+		keys[values[i]] = values[i+1]
+	}
+
+	// Return the map with no error.
+	return keys, nil
+}
+
+func (r *redisBackend) AddToKeyList(name, key, comment string) error {
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Run the SET command and return any error.
+	_, err := conn.Do("HMSET", r.keyListKey(name), key, comment)
+	return err
+}
+
+func (r *redisBackend) RemoveFromKeyList(name, key string) error {
+
+	// Get a connection from the pool and defer its closing.
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	// Run the DEL command and return any error.
+	_, err := conn.Do("HDEL", r.keyListKey(name), key)
+	return err
+}
+
+func (r *redisBackend) Close() error {
+
+	// Close the pool, along with any idle connections.
+	return r.pool.Close()
+}
@@ -32,3 +32,23 @@ func TestGetSet(t *testing.T) {
 		t.Errorf("\n%s\n%s\nRetrieved text did not match!", valueString, v)
 	}
 }
+
+func TestSetGroupWithKey(t *testing.T) {
+
+	r := New("test", "tcp", "127.0.0.1:6379")
+
+	defer r.RemoveGroup("withkey")
+	defer r.RemoveGroupKey("withkey")
+
+	if err := r.SetGroupWithKey("withkey", "key", map[string]string{"A": "1", "B": "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if key, err := r.GetGroupKey("withkey"); err != nil || key != "key" {
+		t.Errorf("unexpected key %q and error %v", key, err)
+	}
+
+	if variables, err := r.GetGroup("withkey"); err != nil || len(variables) != 2 || variables["B"] != "2" {
+		t.Errorf("unexpected variables %v and error %v", variables, err)
+	}
+}
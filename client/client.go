@@ -0,0 +1,323 @@
+// Package client reads and writes stocker variables from Go programs.
+//
+// A Client keeps a single connection and subsystem session open to the
+// server, reconnecting as needed, so that services can fetch their secrets
+// in-process rather than running stocker exec.
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/buth/stocker/auth"
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by Get if the variable isn't set.
+	ErrNotFound = errors.New("client: variable not found")
+
+	// ErrClosed is returned by requests made after Close.
+	ErrClosed = errors.New("client: closed")
+)
+
+// Config describes how to connect to a stocker server.
+type Config struct {
+
+	// Address is the address of the server. Unix sockets are given as
+	// "unix:" followed by the path of the socket. Several servers may be
+	// given as a comma separated list, or as an SRV name prefixed with
+	// "srv:", as accepted by auth.ResolveAddresses.
+	Address string
+
+	// Failover controls how the servers are tried when connecting. If it is
+	// nil, auth.DefaultFailover is used.
+	Failover *auth.Failover
+
+	// User is the user to connect as, either auth.ReaderUser or
+	// auth.WriterUser. Readers can't set or unset variables. The default is
+	// auth.ReaderUser.
+	User string
+
+	// PrivateKey is an SSH private key in the OpenSSH format or PEM
+	// encoded. If it is nil, keys are taken from ssh-agent.
+	PrivateKey []byte
+
+	// Passphrase is called to get the passphrase of an encrypted private
+	// key.
+	Passphrase auth.PassphraseFunc
+
+	// AgentKey selects the ssh-agent keys with this SHA256 fingerprint or
+	// comment. If it is empty, every key in ssh-agent is offered.
+	AgentKey string
+
+	// HostKeyCallback verifies the server's host key. If it is nil, every
+	// host key is rejected.
+	HostKeyCallback auth.HostKeyCallback
+
+	// Timeout limits how long each request, including any reconnection, may
+	// take. Zero means requests are only limited by their context.
+	Timeout time.Duration
+}
+
+// A Client is a connection to a stocker server. It is safe for use by
+// multiple goroutines, though requests are sent one at a time.
+type Client struct {
+	config    Config
+	sshConfig *ssh.ClientConfig
+
+	// The connection and session, which are nil when disconnected. They
+	// may only be used while holding the semaphore.
+	conn    auth.Client
+	session auth.Session
+	closed  bool
+
+	// The semaphore is a channel rather than a mutex so that callers
+	// waiting for it can give up when their context is done.
+	semaphore chan struct{}
+}
+
+// New connects to the server described by config.
+func New(ctx context.Context, config Config) (*Client, error) {
+
+	// Read from the server unless told otherwise.
+	if config.User == "" {
+		config.User = auth.ReaderUser
+	}
+
+	key := &auth.ClientKey{
+		PrivateKey: config.PrivateKey,
+		Passphrase: config.Passphrase,
+		AgentKey:   config.AgentKey,
+	}
+
+	sshConfig, err := auth.ClientConfig(config.User, key, config.HostKeyCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		config:    config,
+		sshConfig: sshConfig,
+		semaphore: make(chan struct{}, 1),
+	}
+
+	// Connect now so that configuration problems are reported immediately.
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// withTimeout applies the configured timeout, if any, to the context.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+
+	if c.config.Timeout > 0 {
+		return context.WithTimeout(ctx, c.config.Timeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// connect dials the server and starts a session. The semaphore must be held
+// or the client not yet shared.
+func (c *Client) connect(ctx context.Context) error {
+
+	conn, err := auth.DialClient(ctx, c.config.Address, c.sshConfig, c.config.Failover)
+	if err != nil {
+		return err
+	}
+
+	session, err := conn.OpenSession()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.conn = conn
+	c.session = session
+
+	return nil
+}
+
+// disconnect closes the session and connection, ignoring any errors. The
+// semaphore must be held.
+func (c *Client) disconnect() {
+
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do sends a request, reconnecting if there is no connection. If a reused
+// connection turns out to be broken, the request is retried once on a new
+// one.
+func (c *Client) do(ctx context.Context, request *auth.Request) (*auth.Response, error) {
+
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	// Wait for our turn to use the session.
+	select {
+	case c.semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	defer func() { <-c.semaphore }()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	for attempt := 0; ; attempt++ {
+
+		reused := c.session != nil
+		if !reused {
+			if err := c.connect(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		response, err := c.doSession(ctx, request)
+		if err == nil {
+			return response, nil
+		}
+
+		// Errors reported by the server leave the session usable.
+		if _, ok := err.(*auth.ProtocolError); ok {
+			return nil, err
+		}
+
+		c.disconnect()
+
+		if !reused || attempt > 0 || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// doSession sends a request over the current session, giving up if the
+// context is done first. The semaphore must be held.
+func (c *Client) doSession(ctx context.Context, request *auth.Request) (*auth.Response, error) {
+
+	type result struct {
+		response *auth.Response
+		err      error
+	}
+
+	// The result channel is buffered so that the goroutine can finish after
+	// it has been abandoned.
+	results := make(chan result, 1)
+	session := c.session
+	go func() {
+		response, err := session.Do(request)
+		results <- result{response, err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.response, r.err
+	case <-ctx.Done():
+
+		// A response may still be on its way, so the session can't be
+		// reused. Disconnecting also ends the abandoned request.
+		c.disconnect()
+		return nil, ctx.Err()
+	}
+}
+
+// Env returns every variable in the group.
+func (c *Client) Env(ctx context.Context, group string) (map[string]string, error) {
+
+	response, err := c.do(ctx, &auth.Request{Command: "env", Group: group})
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Variables == nil {
+		return make(map[string]string), nil
+	}
+
+	return response.Variables, nil
+}
+
+// Get returns the value of a single variable in the group, or ErrNotFound if
+// it isn't set.
+func (c *Client) Get(ctx context.Context, group, name string) (string, error) {
+
+	response, err := c.do(ctx, &auth.Request{Command: "env", Group: group, Names: []string{name}})
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := response.Variables[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return value, nil
+}
+
+// Set sets a variable in the group.
+func (c *Client) Set(ctx context.Context, group, name, value string) error {
+	return c.SetMany(ctx, group, map[string]string{name: value})
+}
+
+// SetMany sets several variables in the group with a single request.
+func (c *Client) SetMany(ctx context.Context, group string, variables map[string]string) error {
+
+	_, err := c.do(ctx, &auth.Request{Command: "export", Group: group, Variables: variables})
+	return err
+}
+
+// Unset removes the named variables from the group.
+func (c *Client) Unset(ctx context.Context, group string, names ...string) error {
+
+	_, err := c.do(ctx, &auth.Request{Command: "unset", Group: group, Names: names})
+	return err
+}
+
+// ListGroups returns the groups the client is allowed to read.
+func (c *Client) ListGroups(ctx context.Context) ([]string, error) {
+
+	response, err := c.do(ctx, &auth.Request{Command: "groups"})
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Groups, nil
+}
+
+// Close closes the connection, waiting for any request in progress to
+// finish. Requests made after Close return ErrClosed.
+func (c *Client) Close() error {
+
+	c.semaphore <- struct{}{}
+	defer func() { <-c.semaphore }()
+
+	c.closed = true
+
+	var err error
+	if c.session != nil {
+		c.session.Close()
+		c.session = nil
+	}
+
+	if c.conn != nil {
+		err = c.conn.Close()
+		c.conn = nil
+	}
+
+	return err
+}
@@ -0,0 +1,236 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/buth/stocker/auth"
+	"github.com/buth/stocker/backend/redis"
+	"github.com/buth/stocker/crypto"
+	"golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+)
+
+const clientTestAddress = `:2024`
+
+// newTestServer starts a server that accepts a newly generated client key,
+// returning it along with the configuration needed to connect.
+func newTestServer(t *testing.T, user string) (auth.Server, Config) {
+
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := crypto.NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := auth.NewServer(redis.New("test", "tcp", "127.0.0.1:6379"), crypto.NewLocalKeyProvider(c), hostSigner)
+	s.AddReadKey(clientSigner.PublicKey())
+	s.AddWriteKey(clientSigner.PublicKey())
+
+	go s.ListenAndServe(clientTestAddress)
+
+	config := Config{
+		Address:         clientTestAddress,
+		User:            user,
+		PrivateKey:      pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(clientKey)}),
+		HostKeyCallback: auth.PinnedHostKey(auth.FingerprintKey(hostSigner.PublicKey())),
+		Timeout:         10 * time.Second,
+	}
+
+	return s, config
+}
+
+func TestClient(t *testing.T) {
+
+	server, config := newTestServer(t, auth.WriterUser)
+	defer server.Stop()
+
+	ctx := context.Background()
+	client, err := New(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	if err := client.SetMany(ctx, "client", map[string]string{"A": "1", "B": "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.Set(ctx, "client", "C", "3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if variables, err := client.Env(ctx, "client"); err != nil {
+		t.Error(err)
+	} else if !equalVariables(variables, map[string]string{"A": "1", "B": "2", "C": "3"}) {
+		t.Error(variables)
+	}
+
+	if value, err := client.Get(ctx, "client", "B"); err != nil {
+		t.Error(err)
+	} else if value != "2" {
+		t.Error(value)
+	}
+
+	if err := client.Unset(ctx, "client", "A", "B"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := client.Get(ctx, "client", "A"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound but found %v!", err)
+	}
+
+	if groups, err := client.ListGroups(ctx); err != nil {
+		t.Error(err)
+	} else {
+		found := false
+		for _, group := range groups {
+			found = found || group == "client"
+		}
+
+		if !found {
+			t.Error(groups)
+		}
+	}
+
+	if err := client.Unset(ctx, "client", "C"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientReader(t *testing.T) {
+
+	server, config := newTestServer(t, auth.ReaderUser)
+	defer server.Stop()
+
+	ctx := context.Background()
+	client, err := New(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	// The server's error should be returned, and the session kept.
+	if err := client.Set(ctx, "client", "A", "1"); err == nil {
+		t.Error("write allowed for reader")
+	} else if protocolErr, ok := err.(*auth.ProtocolError); !ok || protocolErr.Code != auth.ErrorCodeUnauthorized {
+		t.Errorf("expected an unauthorized error but found %v!", err)
+	}
+
+	if _, err := client.Env(ctx, "client"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+
+	server, config := newTestServer(t, auth.ReaderUser)
+	defer server.Stop()
+
+	client, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled context should stop a request before it is sent.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := client.Env(ctx, "client"); err != context.Canceled {
+		t.Errorf("expected context.Canceled but found %v!", err)
+	}
+
+	// The client should still work afterwards.
+	if _, err := client.Env(context.Background(), "client"); err != nil {
+		t.Error(err)
+	}
+
+	client.Close()
+
+	if _, err := client.Env(context.Background(), "client"); err != ErrClosed {
+		t.Errorf("expected ErrClosed but found %v!", err)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+
+	server, config := newTestServer(t, auth.WriterUser)
+	defer server.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := New(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	updates := client.Watch(ctx, "watch", 10*time.Millisecond)
+
+	// The first update holds the current variables.
+	if update := <-updates; update.Err != nil || len(update.Variables) != 0 {
+		t.Error(update)
+	}
+
+	if err := client.Set(ctx, "watch", "A", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if update := <-updates; update.Err != nil || update.Variables["A"] != "1" {
+		t.Error(update)
+	}
+
+	if err := client.Unset(ctx, "watch", "A"); err != nil {
+		t.Error(err)
+	}
+
+	// The channel is closed once the context is done.
+	cancel()
+	for range updates {
+	}
+}
+
+func TestEqualVariables(t *testing.T) {
+
+	if !equalVariables(map[string]string{"A": "1"}, map[string]string{"A": "1"}) {
+		t.Error("equal variables reported as different")
+	}
+
+	if !equalVariables(nil, map[string]string{}) {
+		t.Error("empty variables reported as different")
+	}
+
+	if equalVariables(map[string]string{"A": "1"}, map[string]string{"A": "2"}) {
+		t.Error("different values reported as equal")
+	}
+
+	if equalVariables(map[string]string{"A": "1"}, map[string]string{"B": "1"}) {
+		t.Error("different names reported as equal")
+	}
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// An Update reports the variables of a watched group, or an error if they
+// couldn't be read.
+type Update struct {
+	Variables map[string]string
+	Err       error
+}
+
+// Watch polls the group every interval and sends an update whenever its
+// variables change. The first update holds the variables at the time Watch
+// is called. Errors are sent as updates and polling continues. The channel is
+// closed once the context is done.
+func (c *Client) Watch(ctx context.Context, group string, interval time.Duration) <-chan Update {
+
+	updates := make(chan Update)
+	go func() {
+		defer close(updates)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last map[string]string
+		first := true
+		for {
+
+			variables, err := c.Env(ctx, group)
+
+			// Stop without reporting an error caused by the context.
+			if ctx.Err() != nil {
+				return
+			}
+
+			var update *Update
+			if err != nil {
+				update = &Update{Err: err}
+			} else if first || !equalVariables(last, variables) {
+				update = &Update{Variables: variables}
+				last = variables
+				first = false
+			}
+
+			if update != nil {
+				select {
+				case updates <- *update:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return updates
+}
+
+// equalVariables reports whether a and b hold the same variables.
+func equalVariables(a, b map[string]string) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for variable, value := range a {
+		if otherValue, ok := b[variable]; !ok || otherValue != value {
+			return false
+		}
+	}
+
+	return true
+}
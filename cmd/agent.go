@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/buth/stocker/agent"
+	"github.com/buth/stocker/auth"
+	"github.com/buth/stocker/client"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var Agent = &Command{
+	UsageLine: "agent [options]",
+	Short:     "cache groups for local processes",
+	Long: `Agent connects to a stocker server as a reader and serves the groups it reads
+to local processes over a Unix socket, caching each group for the TTL. Use
+"stocker exec -agent SOCKET" to read from the agent.`,
+}
+
+var agentConfig struct {
+	Address, PrivateFilepath, SocketFilepath, SocketMode, AgentKey string
+	KnownHostsFilepath, HostFingerprint                            string
+	TrustOnFirstUse, LockMemory                                    bool
+	TTL, Timeout                                                   time.Duration
+}
+
+func init() {
+	Agent.Run = agentRun
+	Agent.Flag.StringVar(&agentConfig.Address, "a", ":2022", "address of the stocker server")
+	Agent.Flag.StringVar(&agentConfig.PrivateFilepath, "i", "", "path to an SSH private key")
+	Agent.Flag.StringVar(&agentConfig.AgentKey, "agent-key", "", "use the ssh-agent key with this SHA256 fingerprint or comment")
+	Agent.Flag.StringVar(&agentConfig.KnownHostsFilepath, "known-hosts", "", "verify the server's host key using this known_hosts file")
+	Agent.Flag.StringVar(&agentConfig.HostFingerprint, "host-fingerprint", "", "verify the server's host key has this SHA256 fingerprint")
+	Agent.Flag.BoolVar(&agentConfig.TrustOnFirstUse, "tofu", false, "trust and record the host key of servers not in the known_hosts file")
+	Agent.Flag.StringVar(&agentConfig.SocketFilepath, "s", "/run/stocker/agent.sock", "path of the Unix socket to listen on")
+	Agent.Flag.StringVar(&agentConfig.SocketMode, "socket-mode", "0660", "permissions of the Unix socket, in octal")
+	Agent.Flag.DurationVar(&agentConfig.TTL, "ttl", agent.DefaultTTL, "how long to cache each group")
+	Agent.Flag.DurationVar(&agentConfig.Timeout, "timeout", 30*time.Second, "time allowed for each request to the server")
+	Agent.Flag.BoolVar(&agentConfig.LockMemory, "mlock", true, "lock the agent's memory so that cached values are never swapped to disk")
+}
+
+// agentLockMemory locks the process's memory, now and in the future, so that
+// it can't be swapped out, and disables core dumps.
+func agentLockMemory() error {
+
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{}); err != nil {
+		return err
+	}
+
+	if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
+		return fmt.Errorf("could not lock memory (%s); run with CAP_IPC_LOCK or a higher memlock limit, or use -mlock=false", err)
+	}
+
+	return nil
+}
+
+func agentRun(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 0 {
+		cmd.Usage(2)
+	}
+
+	// Lock memory before anything secret is read.
+	if agentConfig.LockMemory {
+		if err := agentLockMemory(); err != nil {
+			cmd.Fatal(err.Error())
+		}
+	}
+
+	socketMode, err := strconv.ParseUint(agentConfig.SocketMode, 8, 32)
+	if err != nil {
+		cmd.Fatal(fmt.Sprintf("invalid socket mode %q", agentConfig.SocketMode))
+	}
+
+	// Read the private key from disk if a filepath has been provided,
+	// prompting for its passphrase if it is encrypted.
+	key, err := clientKey(agentConfig.PrivateFilepath, agentConfig.AgentKey)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Build the host key callback.
+	hostKeyCallback, err := clientHostKeyCallback(agentConfig.KnownHostsFilepath, agentConfig.HostFingerprint, agentConfig.TrustOnFirstUse)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Connect once. The client keeps the connection open, reconnecting if it
+	// breaks. If the private key is nil, ssh-agent is used.
+	c, err := client.New(context.Background(), client.Config{
+		Address:         agentConfig.Address,
+		User:            auth.ReaderUser,
+		PrivateKey:      key.PrivateKey,
+		Passphrase:      key.Passphrase,
+		AgentKey:        key.AgentKey,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         agentConfig.Timeout,
+	})
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	listener, err := auth.Listen("unix:"+agentConfig.SocketFilepath, os.FileMode(socketMode))
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	a := agent.New(c, agentConfig.TTL)
+
+	// Flush the cache on SIGHUP, and stop on SIGTERM or SIGINT.
+	go func() {
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+
+		for received := range signals {
+
+			if received == syscall.SIGHUP {
+				log.Println("agent: flushing the cache")
+				a.Flush()
+				continue
+			}
+
+			log.Printf("agent: received %s, shutting down\n", received)
+			a.Stop()
+			return
+		}
+	}()
+
+	log.Printf("agent: listening on %s\n", agentConfig.SocketFilepath)
+	if err := a.Serve(listener); err != nil {
+		log.Fatal(err)
+	}
+
+	c.Close()
+}
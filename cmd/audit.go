@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/buth/stocker/audit"
+	"os"
+)
+
+var Audit = &Command{
+	UsageLine: "audit [options] filename",
+	Short:     "verify the hash chain of an audit log",
+	Long: `Audit verifies an audit log written by a server started with -audit-chain,
+using the same key, reporting the first event that has been changed, removed
+or inserted.`,
+}
+
+var auditConfig struct {
+	KeyFilepath, Head string
+}
+
+func init() {
+	Audit.Run = auditRun
+	Audit.Flag.StringVar(&auditConfig.KeyFilepath, "k", "/etc/stocker/audit-key", "path to the secret the audit log chain is keyed with")
+	Audit.Flag.StringVar(&auditConfig.Head, "head", "", "expected hash of the last event, as recorded in syslog by -audit-anchor")
+}
+
+func auditRun(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 1 {
+		cmd.Usage(2)
+	}
+
+	key, err := readSecret(auditConfig.KeyFilepath)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Defer the closing of the file, ignoring any error.
+	defer file.Close()
+
+	n, head, err := audit.Verify(file, key)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Events removed from the end of the log leave an intact chain, so they
+	// can only be detected by comparing with the anchored head.
+	if auditConfig.Head != "" && head != auditConfig.Head {
+		cmd.Fatal(fmt.Sprintf("the last event's hash %s does not match the head %s; events are missing", head, auditConfig.Head))
+	}
+
+	fmt.Printf("ok: %d events verified, head %s\n", n, head)
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"code.google.com/p/gopass"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/buth/stocker/auth"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Exit codes used when a command fails on the server. Other failures exit
+// with status 1.
+const (
+	clientExitUnauthorized   = 3
+	clientExitSealed         = 4
+	clientExitInvalidRequest = 5
+	clientExitDecrypt        = 6
+	clientExitInternal       = 7
+)
+
+// clientFatal reports an error from the server and exits. Errors the server
+// has explained are printed with a hint and exit with a status identifying
+// their kind.
+func clientFatal(cmd *Command, err error) {
+
+	protocolErr, ok := err.(*auth.ProtocolError)
+	if !ok {
+		cmd.Fatal(err.Error())
+		return
+	}
+
+	var code int
+	var hint string
+	switch protocolErr.Code {
+	case auth.ErrorCodeUnauthorized:
+		code, hint = clientExitUnauthorized, "check that this key may use the group, and that writes use a writer key"
+	case auth.ErrorCodeSealed:
+		code, hint = clientExitSealed, "the server must be unsealed with the unseal command"
+	case auth.ErrorCodeInvalidRequest, auth.ErrorCodeUnsupportedVersion:
+		code, hint = clientExitInvalidRequest, "the server did not understand the request; check that the client and server versions match"
+	case auth.ErrorCodeDecrypt:
+		code, hint = clientExitDecrypt, "a value could not be decrypted; check the server's key"
+	default:
+		code, hint = clientExitInternal, "the server failed; check its log"
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %s\n%s\n", cmd.Name(), protocolErr.Message, hint)
+	os.Exit(code)
+}
+
+// clientHostKeyCallback returns the callback used to verify the server's
+// host key, given the values of the -known-hosts, -host-fingerprint and
+// -tofu flags. It is an error to configure neither a known hosts file nor a
+// fingerprint, so that clients fail closed, or to ask for trust on first use
+// without a known hosts file to record keys in.
+func clientHostKeyCallback(knownHostsFilepath, hostFingerprint string, trustOnFirstUse bool) (auth.HostKeyCallback, error) {
+
+	switch {
+	case hostFingerprint != "" && knownHostsFilepath != "":
+		return nil, errors.New("-known-hosts and -host-fingerprint cannot be used together")
+	case trustOnFirstUse && knownHostsFilepath == "":
+		return nil, errors.New("-tofu requires -known-hosts")
+	case hostFingerprint != "":
+		return auth.PinnedHostKey(hostFingerprint), nil
+	case knownHostsFilepath != "":
+		return auth.KnownHosts(knownHostsFilepath, trustOnFirstUse)
+	}
+
+	return nil, errors.New("host key verification is not configured; use -known-hosts or -host-fingerprint")
+}
+
+// clientFailover returns the failover described by the -random,
+// -attempt-timeout and -retries flags, backing off as auth.DefaultFailover
+// does.
+func clientFailover(randomize bool, attemptTimeout time.Duration, retries int) *auth.Failover {
+
+	return &auth.Failover{
+		Randomize:      randomize,
+		AttemptTimeout: attemptTimeout,
+		Retries:        retries,
+		Backoff:        auth.DefaultFailover.Backoff,
+		MaxBackoff:     auth.DefaultFailover.MaxBackoff,
+	}
+}
+
+// clientKey returns the key described by the -i and -agent-key flags. The
+// passphrase of an encrypted private key is prompted for when the key is
+// parsed.
+func clientKey(privateFilepath, agentKey string) (*auth.ClientKey, error) {
+
+	key := &auth.ClientKey{AgentKey: agentKey}
+	if privateFilepath == "" {
+		return key, nil
+	}
+
+	privateKey, err := ioutil.ReadFile(privateFilepath)
+	if err != nil {
+		return nil, err
+	}
+
+	key.PrivateKey = privateKey
+	key.Passphrase = func() ([]byte, error) {
+		passphrase, err := gopass.GetPass(fmt.Sprintf("Enter passphrase for %s: ", privateFilepath))
+		return []byte(passphrase), err
+	}
+
+	return key, nil
+}
+
+// clientConnect connects to the first server in address that answers, as
+// described by failover. If failover is nil, auth.DefaultFailover is used.
+func clientConnect(user, address string, key *auth.ClientKey, hostKeyCallback auth.HostKeyCallback, failover *auth.Failover) (auth.Client, error) {
+
+	config, err := auth.ClientConfig(user, key, hostKeyCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	return auth.DialClient(context.Background(), address, config, failover)
+}
@@ -2,14 +2,15 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/buth/stocker/agent"
 	"github.com/buth/stocker/auth"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 var Exec = &Command{
@@ -29,43 +30,50 @@ func (s *StringAcumulator) String() string {
 }
 
 var execConfig struct {
-	Address, PrivateFilepath, Group, User string
+	Address, PrivateFilepath, Group, User, AgentKey string
+	AgentFilepath                                   string
+	KnownHostsFilepath, HostFingerprint             string
+	TrustOnFirstUse, Randomize                      bool
+	AttemptTimeout                                  time.Duration
+	Retries                                         int
 }
 
 func init() {
 	Exec.Run = execRun
-	Exec.Flag.StringVar(&execConfig.Address, "a", ":2022", "address of the stocker server")
+	Exec.Flag.StringVar(&execConfig.Address, "a", ":2022", "address of the stocker server, a comma separated list of servers to fail over between, or srv:NAME to look them up in DNS")
+	Exec.Flag.BoolVar(&execConfig.Randomize, "random", false, "try the servers in a random order rather than the order given")
+	Exec.Flag.DurationVar(&execConfig.AttemptTimeout, "attempt-timeout", auth.DefaultFailover.AttemptTimeout, "time allowed for each attempt to connect to a server")
+	Exec.Flag.IntVar(&execConfig.Retries, "retries", auth.DefaultFailover.Retries, "number of times to retry, with backoff, once every server has failed")
 	Exec.Flag.StringVar(&execConfig.Group, "g", "", "group to use for storing and retrieving data")
 	Exec.Flag.StringVar(&execConfig.PrivateFilepath, "i", "", "path to an SSH private key")
+	Exec.Flag.StringVar(&execConfig.AgentKey, "agent-key", "", "use the ssh-agent key with this SHA256 fingerprint or comment")
+	Exec.Flag.StringVar(&execConfig.KnownHostsFilepath, "known-hosts", "", "verify the server's host key using this known_hosts file")
+	Exec.Flag.StringVar(&execConfig.HostFingerprint, "host-fingerprint", "", "verify the server's host key has this SHA256 fingerprint")
+	Exec.Flag.BoolVar(&execConfig.TrustOnFirstUse, "tofu", false, "trust and record the host key of servers not in the known_hosts file")
 	Exec.Flag.StringVar(&execConfig.User, "u", "", "user to execute the command as")
+	Exec.Flag.StringVar(&execConfig.AgentFilepath, "agent", "", "read the group from the agent listening on this Unix socket instead of the server")
 }
 
-func execRun(cmd *Command, args []string) {
-
-	// Check the number of args.
-	if len(args) < 1 {
-		cmd.Usage(2)
-	}
+// execServerEnv reads the group's variables from the server.
+func execServerEnv(cmd *Command) map[string]string {
 
-	// Find the expanded path to cmd.
-	command, err := exec.LookPath(args[0])
+	// Read the private key from disk if a filepath has been provided,
+	// prompting for its passphrase if it is encrypted.
+	key, err := clientKey(execConfig.PrivateFilepath, execConfig.AgentKey)
 	if err != nil {
-		cmd.Fatal(fmt.Sprintf("%s: command not found", args[0]))
+		cmd.Fatal(err.Error())
 	}
 
-	// Read the private key from disk if a filepath has been provided.
-	var privateKey []byte
-	if execConfig.PrivateFilepath != "" {
-		privateKeyBytes, err := ioutil.ReadFile(execConfig.PrivateFilepath)
-		if err != nil {
-			cmd.Fatal(err.Error())
-		}
-		privateKey = privateKeyBytes
+	// Build the host key callback.
+	hostKeyCallback, err := clientHostKeyCallback(execConfig.KnownHostsFilepath, execConfig.HostFingerprint, execConfig.TrustOnFirstUse)
+	if err != nil {
+		cmd.Fatal(err.Error())
 	}
 
-	// Get a new client object. If the private key is nil, the method will
-	// attempt to use ssh-agent.
-	client, err := auth.NewClient(auth.ReaderUser, execConfig.Address, privateKey)
+	// Get a new client object, failing over between the servers given. If
+	// the private key is nil, the method will attempt to use ssh-agent.
+	failover := clientFailover(execConfig.Randomize, execConfig.AttemptTimeout, execConfig.Retries)
+	client, err := clientConnect(auth.ReaderUser, execConfig.Address, key, hostKeyCallback, failover)
 	if err != nil {
 		cmd.Fatal(err.Error())
 	}
@@ -77,7 +85,45 @@ func execRun(cmd *Command, args []string) {
 
 	stockerEnv, err := client.Run("env", runEnv)
 	if err != nil {
-		cmd.Fatal(err.Error())
+		clientFatal(cmd, err)
+	}
+
+	// Parse the stocker environment.
+	variables := make(map[string]string)
+	pairs := strings.Split(stockerEnv, "\n")
+	for _, pair := range pairs {
+		components := strings.SplitN(pair, "=", 2)
+		if len(components) == 2 {
+			variables[components[0]] = components[1]
+		}
+	}
+
+	return variables
+}
+
+func execRun(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) < 1 {
+		cmd.Usage(2)
+	}
+
+	// Find the expanded path to cmd.
+	command, err := exec.LookPath(args[0])
+	if err != nil {
+		cmd.Fatal(fmt.Sprintf("%s: command not found", args[0]))
+	}
+
+	// Read the group from the agent if one was given, and otherwise from
+	// the server.
+	var stockerEnv map[string]string
+	if execConfig.AgentFilepath != "" {
+		stockerEnv, err = agent.Env(execConfig.AgentFilepath, execConfig.Group)
+		if err != nil {
+			clientFatal(cmd, err)
+		}
+	} else {
+		stockerEnv = execServerEnv(cmd)
 	}
 
 	// Create a map of environment variables to be passed to cmd and
@@ -88,13 +134,9 @@ func execRun(cmd *Command, args []string) {
 		env[components[0]] = components[1]
 	}
 
-	// Parse the stocker environment and save it into the env.
-	pairs := strings.Split(stockerEnv, "\n")
-	for _, pair := range pairs {
-		components := strings.SplitN(pair, "=", 2)
-		if len(components) == 2 {
-			env[components[0]] = components[1]
-		}
+	// Save the stocker environment into the env.
+	for variable, value := range stockerEnv {
+		env[variable] = value
 	}
 
 	// Create a list of environment key/value pairs and write the
@@ -1,37 +1,250 @@
 package cmd
 
 import (
+	"fmt"
+	"github.com/buth/stocker/backend"
 	"github.com/buth/stocker/crypto"
 	"log"
+	"os"
 )
 
 var Key = &Command{
-	UsageLine: "key filename",
+	UsageLine: "key [options] [filename]",
 	Short:     "create a key saved at the given filename",
+	Long: `Key creates a new key saved at the given filename, or prints it as shares.
+
+	stocker key inspect filename
+
+validates the mode, format and length of an existing key file and prints the
+fingerprint and metadata of each key without revealing them.
+
+	stocker key add filename
+
+adds a new primary key to an existing key file. Older keys are kept so that
+values encrypted with them can still be decrypted.
+
+	stocker key verify filename [options]
+
+samples the data keys and values stored in a backend and reports whether the
+key saved at the given filename can decrypt them.`,
+}
+
+var keyConfig struct {
+	Shares, Threshold, Samples                                 int
+	Backend, BackendNamespace, BackendProtocol, BackendAddress string
 }
 
 func init() {
 	Key.Run = keyRun
+	Key.Flag.IntVar(&keyConfig.Shares, "shares", 0, "split the key into this many shares instead of saving it")
+	Key.Flag.IntVar(&keyConfig.Threshold, "threshold", 0, "number of shares required to reconstruct the key")
+	Key.Flag.StringVar(&keyConfig.Backend, "b", "redis", "backend to verify against")
+	Key.Flag.StringVar(&keyConfig.BackendAddress, "h", ":6379", "backend address")
+	Key.Flag.StringVar(&keyConfig.BackendNamespace, "n", "stocker", "backend namespace")
+	Key.Flag.StringVar(&keyConfig.BackendProtocol, "t", "tcp", "backend connection protocol")
+	Key.Flag.IntVar(&keyConfig.Samples, "samples", 5, "number of values to sample from each group without a data key")
 }
 
 func keyRun(cmd *Command, args []string) {
 
-	// Check the number of args.
-	if len(args) != 1 {
-		cmd.Usage(2)
+	// Check for a subcommand.
+	if len(args) > 0 {
+		switch args[0] {
+		case "inspect":
+			keyInspect(cmd, args[1:])
+			return
+		case "add":
+			keyAdd(cmd, args[1:])
+			return
+		case "verify":
+			keyVerify(cmd, args[1:])
+			return
+		}
 	}
 
-	// Set the filename.
-	filename := args[0]
-
 	// Create a random crypter object.
 	c, err := crypto.NewRandomCrypter()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// If shares have been requested, print them instead of writing a file so
+	// that no single operator holds the whole key.
+	if keyConfig.Shares > 0 {
+
+		// Check the number of args.
+		if len(args) != 0 {
+			cmd.Usage(2)
+		}
+
+		shares, err := c.Split(keyConfig.Shares, keyConfig.Threshold)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, share := range shares {
+			fmt.Println(share)
+		}
+
+		return
+	}
+
+	// Check the number of args.
+	if len(args) != 1 {
+		cmd.Usage(2)
+	}
+
+	// Set the filename.
+	filename := args[0]
+
 	// Write out the key to the given filename.
 	if err := c.ToFile(filename); err != nil {
 		log.Fatal(err)
 	}
 }
+
+func keyInspect(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 1 {
+		cmd.Usage(2)
+	}
+
+	info, err := crypto.InspectKeyFile(args[0])
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	fmt.Printf("format:   %s\n", info.Format)
+	fmt.Printf("mode:     %s\n", info.Mode)
+	fmt.Printf("modified: %s\n", info.Modified.Format("2006-01-02T15:04:05Z07:00"))
+
+	for _, key := range info.Keys {
+
+		created := "unknown"
+		if !key.Created.IsZero() {
+			created = key.Created.Format("2006-01-02T15:04:05Z07:00")
+		}
+
+		purpose := "unknown"
+		if key.Purpose != "" {
+			purpose = key.Purpose
+		}
+
+		fmt.Printf("\nid:          %s\n", key.ID)
+		fmt.Printf("fingerprint: %s\n", key.Fingerprint)
+		fmt.Printf("algorithm:   %s\n", key.Algorithm)
+		fmt.Printf("purpose:     %s\n", purpose)
+		fmt.Printf("created:     %s\n", created)
+	}
+}
+
+func keyAdd(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 1 {
+		cmd.Usage(2)
+	}
+
+	key, err := crypto.AddKeyToFile(args[0])
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	fmt.Printf("added key %s (%s)\n", key.ID, key.Fingerprint)
+}
+
+func keyVerify(cmd *Command, args []string) {
+
+	// Check the number of args. Options follow the filename, so they still
+	// need to be parsed.
+	if len(args) < 1 {
+		cmd.Usage(2)
+	}
+
+	filename := args[0]
+	cmd.Flag.Parse(args[1:])
+	if cmd.Flag.NArg() != 0 {
+		cmd.Usage(2)
+	}
+
+	info, err := crypto.InspectKeyFile(filename)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	c, err := crypto.NewKeyringFromFile(filename)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	b, err := backend.NewBackend(keyConfig.Backend, keyConfig.BackendNamespace, keyConfig.BackendProtocol, keyConfig.BackendAddress)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	for _, key := range info.Keys {
+		fmt.Printf("fingerprint: %s\n", key.Fingerprint)
+	}
+
+	keys, err := b.GetGroupKeys()
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	groups, err := b.ListGroups()
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	failures := 0
+
+	// Groups with data keys only need their key to be unwrapped.
+	for group, wrapped := range keys {
+		if _, err := crypto.UnwrapKey(c, wrapped); err != nil {
+			fmt.Printf("FAIL %q: data key: %s\n", group, err)
+			failures++
+		} else {
+			fmt.Printf("ok   %q: data key\n", group)
+		}
+	}
+
+	// Groups without data keys were encrypted with the key directly, so
+	// sample their values.
+	for _, group := range groups {
+
+		if _, ok := keys[group]; ok {
+			continue
+		}
+
+		variables, err := b.GetGroup(group)
+		if err != nil {
+			cmd.Fatal(err.Error())
+		}
+
+		sampled, failed := 0, 0
+		for _, cryptedValue := range variables {
+
+			if sampled == keyConfig.Samples {
+				break
+			}
+			sampled++
+
+			if _, err := c.DecryptString(cryptedValue); err != nil {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			fmt.Printf("FAIL %q: %d of %d sampled values\n", group, failed, sampled)
+			failures++
+		} else {
+			fmt.Printf("ok   %q: %d sampled values\n", group, sampled)
+		}
+	}
+
+	if failures > 0 {
+		fmt.Fprintf(os.Stderr, "%d groups could not be decrypted with this key\n", failures)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/buth/stocker/auth"
+	"io/ioutil"
+	"strings"
+)
+
+var Keys = &Command{
+	UsageLine: "keys [options] list | add reader|writer filename | revoke reader|writer filename",
+	Short:     "manage a server's reader and writer keys",
+	Long: `Keys connects to a server as an administrator to manage its reader and writer
+keys at runtime. Changes are saved to the server's backend.
+
+	stocker keys list
+
+lists every reader and writer key known to the server.
+
+	stocker keys add reader|writer filename
+
+authorizes the public key saved at the given filename.
+
+	stocker keys revoke reader|writer filename
+
+rejects the public key saved at the given filename, even if it is also listed
+in the server's configuration.`,
+}
+
+var keysConfig struct {
+	Address, PrivateFilepath, AgentKey  string
+	KnownHostsFilepath, HostFingerprint string
+	TrustOnFirstUse                     bool
+}
+
+func init() {
+	Keys.Run = keysRun
+	Keys.Flag.StringVar(&keysConfig.Address, "a", ":2022", "address of the stocker server")
+	Keys.Flag.StringVar(&keysConfig.PrivateFilepath, "i", "", "path to an SSH private key")
+	Keys.Flag.StringVar(&keysConfig.AgentKey, "agent-key", "", "use the ssh-agent key with this SHA256 fingerprint or comment")
+	Keys.Flag.StringVar(&keysConfig.KnownHostsFilepath, "known-hosts", "", "verify the server's host key using this known_hosts file")
+	Keys.Flag.StringVar(&keysConfig.HostFingerprint, "host-fingerprint", "", "verify the server's host key has this SHA256 fingerprint")
+	Keys.Flag.BoolVar(&keysConfig.TrustOnFirstUse, "tofu", false, "trust and record the host key of servers not in the known_hosts file")
+}
+
+func keysRun(cmd *Command, args []string) {
+
+	// Build the command to run on the server.
+	var command string
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		command = "keys list"
+	case len(args) == 3 && (args[0] == "add" || args[0] == "revoke"):
+
+		// Map the role to its SSH user.
+		var user string
+		switch args[1] {
+		case "reader":
+			user = auth.ReaderUser
+		case "writer":
+			user = auth.WriterUser
+		default:
+			cmd.Usage(2)
+		}
+
+		publicKey, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			cmd.Fatal(err.Error())
+		}
+
+		command = fmt.Sprintf("keys %s %s %s", args[0], user, strings.TrimSpace(string(publicKey)))
+	default:
+		cmd.Usage(2)
+	}
+
+	// Read the private key from disk if a filepath has been provided,
+	// prompting for its passphrase if it is encrypted.
+	key, err := clientKey(keysConfig.PrivateFilepath, keysConfig.AgentKey)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Build the host key callback.
+	hostKeyCallback, err := clientHostKeyCallback(keysConfig.KnownHostsFilepath, keysConfig.HostFingerprint, keysConfig.TrustOnFirstUse)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Get a new client object. If the private key is nil, the method will
+	// attempt to use ssh-agent.
+	client, err := clientConnect(auth.AdminUser, keysConfig.Address, key, hostKeyCallback, nil)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	output, err := client.Run(command, nil)
+	if err != nil {
+		clientFatal(cmd, err)
+	}
+
+	fmt.Print(output)
+}
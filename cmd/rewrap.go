@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"bytes"
+	"github.com/buth/stocker/backend"
+	"github.com/buth/stocker/crypto"
+	"log"
+)
+
+var Rewrap = &Command{
+	UsageLine: "rewrap [options] filename",
+	Short:     "rewrap group data keys under the key saved at the given filename",
+	Long: `Rewrap unwraps every group's data key with the current key and wraps it
+again with the key saved at the given filename. Groups written before data
+keys were introduced are first given a data key, and their values are
+re-encrypted under it. The server must be stopped while rewrap runs; a data
+key it created in the meantime would stay wrapped under the old key.`,
+}
+
+var rewrapConfig struct {
+	SecretFilepath, Backend, BackendNamespace, BackendProtocol, BackendAddress string
+}
+
+func init() {
+	Rewrap.Run = rewrapRun
+	Rewrap.Flag.StringVar(&rewrapConfig.Backend, "b", "redis", "backend to use")
+	Rewrap.Flag.StringVar(&rewrapConfig.BackendAddress, "h", ":6379", "backend address")
+	Rewrap.Flag.StringVar(&rewrapConfig.BackendNamespace, "n", "stocker", "backend namespace")
+	Rewrap.Flag.StringVar(&rewrapConfig.BackendProtocol, "t", "tcp", "backend connection protocol")
+	Rewrap.Flag.StringVar(&rewrapConfig.SecretFilepath, "k", "/etc/stocker/key", "path to the current encryption key")
+}
+
+func rewrapRun(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 1 {
+		cmd.Usage(2)
+	}
+
+	current, err := crypto.NewKeyringFromFile(rewrapConfig.SecretFilepath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	replacement, err := crypto.NewCrypterFromFile(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b, err := backend.NewBackend(rewrapConfig.Backend, rewrapConfig.BackendNamespace, rewrapConfig.BackendProtocol, rewrapConfig.BackendAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys, err := b.GetGroupKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	groups, err := b.ListGroups()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Groups without a data key are still encrypted directly under the
+	// current key, which is about to be retired. Give each one a data key
+	// and re-encrypt its values under it.
+	migrated := make(map[string]map[string]string)
+	migratedKeys := make(map[string]string)
+	for _, group := range groups {
+
+		if _, ok := keys[group]; ok {
+			continue
+		}
+
+		variables, err := b.GetGroup(group)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		key, err := crypto.NewDataKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		c, err := crypto.NewCrypter(bytes.NewReader(key))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for variable, cryptedValue := range variables {
+
+			value, err := current.DecryptString(cryptedValue)
+			if err != nil {
+				log.Fatalf("group %q: %s", group, err)
+			}
+
+			if variables[variable], err = c.EncryptString(value); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if migratedKeys[group], err = crypto.WrapKey(replacement, key); err != nil {
+			log.Fatal(err)
+		}
+
+		migrated[group] = variables
+	}
+
+	// Unwrap every key before writing any of them so that a bad key doesn't
+	// leave the backend half rewrapped.
+	rewrapped := make(map[string]string)
+	for group, wrapped := range keys {
+
+		key, err := crypto.UnwrapKey(current, wrapped)
+		if err != nil {
+			log.Fatalf("group %q: %s", group, err)
+		}
+
+		rewrapped[group], err = crypto.WrapKey(replacement, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for group, wrapped := range rewrapped {
+		if err := b.SetGroupKey(group, wrapped); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Each migrated group's key and values are saved together.
+	for group, variables := range migrated {
+		if err := b.SetGroupWithKey(group, migratedKeys[group], variables); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Printf("rewrapped %d group keys and added keys to %d groups", len(rewrapped), len(migrated))
+}
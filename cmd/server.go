@@ -1,23 +1,43 @@
 package cmd
 
 import (
-	"code.google.com/p/go.crypto/ssh"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/buth/stocker/audit"
 	"github.com/buth/stocker/auth"
 	"github.com/buth/stocker/backend"
 	"github.com/buth/stocker/crypto"
+	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var serverConfig struct {
 	SecretFilepath, PrivateFilepath, Backend, BackendNamespace, BackendProtocol, BackendAddress, Group, Address, ReadersURL, WritersURL string
+	KeyProvider, KeyProviderURL, PolicyFilepath, UserCAFilepath, ReadersFilepath, WritersFilepath                                       string
+	Audit, AuditFilepath, AuditKeyFilepath, AdminsFilepath, KeyExchanges, Ciphers, MACs, HostKeyAlgorithms                              string
+	HTTPSAddress, HTTPSCertFilepath, HTTPSKeyFilepath, HTTPSClientCAFilepath, TokenSecretFilepath, SocketMode                           string
+	AuditChain, AuditAnchor, FIPS                                                                                                       bool
+	Threshold, MaxConnections, AuthAttempts, BanAfter                                                                                   int
+	RefreshInterval, HandshakeTimeout, BanDuration, ShutdownTimeout                                                                     time.Duration
 }
 
 var serverClient *http.Client
 
+// serverKeyFileInterval is how often key files are checked for changes.
+const serverKeyFileInterval = 10 * time.Second
+
 var Server = &Command{
 	UsageLine: "server [options]",
 	Short:     "start a stocker server",
@@ -25,7 +45,7 @@ var Server = &Command{
 
 func init() {
 	Server.Run = serverRun
-	Server.Flag.StringVar(&serverConfig.Address, "a", ":2022", "address to listen on")
+	Server.Flag.StringVar(&serverConfig.Address, "a", ":2022", "address to listen on, or unix:PATH for a Unix socket")
 	Server.Flag.StringVar(&serverConfig.Backend, "b", "redis", "backend to use")
 	Server.Flag.StringVar(&serverConfig.BackendAddress, "h", ":6379", "backend address")
 	Server.Flag.StringVar(&serverConfig.BackendNamespace, "n", "stocker", "backend namespace")
@@ -34,6 +54,37 @@ func init() {
 	Server.Flag.StringVar(&serverConfig.SecretFilepath, "k", "/etc/stocker/key", "path to encryption key")
 	Server.Flag.StringVar(&serverConfig.ReadersURL, "r", "", "retrieve reader public keys from this URL")
 	Server.Flag.StringVar(&serverConfig.WritersURL, "w", "", "retrieve writer public keys from this URL")
+	Server.Flag.StringVar(&serverConfig.KeyProvider, "key-provider", "file", "key provider to wrap data keys with (file or http)")
+	Server.Flag.StringVar(&serverConfig.KeyProviderURL, "key-url", "", "base URL of the key service for the http key provider")
+	Server.Flag.StringVar(&serverConfig.PolicyFilepath, "policy", "", "path to a policy file restricting the groups each key may use")
+	Server.Flag.StringVar(&serverConfig.UserCAFilepath, "user-ca", "", "trust user certificates signed by the public keys in this file")
+	Server.Flag.StringVar(&serverConfig.ReadersFilepath, "reader-keys-file", "", "load reader public keys from this authorized_keys file")
+	Server.Flag.StringVar(&serverConfig.WritersFilepath, "writer-keys-file", "", "load writer public keys from this authorized_keys file")
+	Server.Flag.StringVar(&serverConfig.AdminsFilepath, "admin-keys-file", "", "load administrator public keys from this authorized_keys file")
+	Server.Flag.DurationVar(&serverConfig.RefreshInterval, "refresh", 5*time.Minute, "interval at which to refresh reader and writer keys (0 to disable)")
+	Server.Flag.IntVar(&serverConfig.Threshold, "threshold", 0, "start sealed, requiring this many key shares to unseal")
+	Server.Flag.StringVar(&serverConfig.Audit, "audit", "", "write an audit log of every command (file, syslog or stdout)")
+	Server.Flag.StringVar(&serverConfig.AuditFilepath, "audit-file", "/var/log/stocker/audit.log", "path to the audit log for the file audit logger")
+	Server.Flag.BoolVar(&serverConfig.AuditChain, "audit-chain", false, "chain audit log events together with hashes so that changes can be detected")
+	Server.Flag.StringVar(&serverConfig.AuditKeyFilepath, "audit-key", "", "path to the secret the audit log chain is keyed with")
+	Server.Flag.BoolVar(&serverConfig.AuditAnchor, "audit-anchor", false, "also record the head of the audit log chain in syslog")
+	Server.Flag.StringVar(&serverConfig.KeyExchanges, "kex", "", "comma separated list of SSH key exchange algorithms, in order of preference")
+	Server.Flag.StringVar(&serverConfig.Ciphers, "ciphers", "", "comma separated list of SSH ciphers, in order of preference")
+	Server.Flag.StringVar(&serverConfig.MACs, "macs", "", "comma separated list of SSH MAC algorithms, in order of preference")
+	Server.Flag.StringVar(&serverConfig.HostKeyAlgorithms, "host-key-algorithms", "", "comma separated list of SSH host key algorithms, in order of preference")
+	Server.Flag.BoolVar(&serverConfig.FIPS, "fips", false, "only negotiate FIPS 140-2 approved SSH algorithms")
+	Server.Flag.IntVar(&serverConfig.MaxConnections, "max-connections", auth.DefaultLimits.MaxConnections, "maximum number of concurrent connections (0 for no limit)")
+	Server.Flag.DurationVar(&serverConfig.HandshakeTimeout, "handshake-timeout", auth.DefaultLimits.HandshakeTimeout, "time allowed to complete the SSH handshake (0 for no limit)")
+	Server.Flag.IntVar(&serverConfig.AuthAttempts, "auth-attempts", auth.DefaultLimits.AuthAttempts, "authentication attempts allowed per host each minute (0 for no limit)")
+	Server.Flag.IntVar(&serverConfig.BanAfter, "ban-after", auth.DefaultLimits.BanAfter, "ban a host after this many failed authentications in a minute (0 to disable)")
+	Server.Flag.DurationVar(&serverConfig.BanDuration, "ban-duration", auth.DefaultLimits.BanDuration, "how long to ban a host for")
+	Server.Flag.DurationVar(&serverConfig.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "time allowed for sessions to finish when shutting down")
+	Server.Flag.StringVar(&serverConfig.HTTPSAddress, "https", "", "also serve the HTTPS gateway on this address")
+	Server.Flag.StringVar(&serverConfig.HTTPSCertFilepath, "https-cert", "/etc/stocker/https.crt", "path to the HTTPS gateway's TLS certificate")
+	Server.Flag.StringVar(&serverConfig.HTTPSKeyFilepath, "https-key", "/etc/stocker/https.key", "path to the HTTPS gateway's TLS private key")
+	Server.Flag.StringVar(&serverConfig.HTTPSClientCAFilepath, "https-client-ca", "", "accept gateway client certificates signed by the CAs in this file")
+	Server.Flag.StringVar(&serverConfig.TokenSecretFilepath, "token-secret", "", "accept gateway tokens signed with the secret in this file")
+	Server.Flag.StringVar(&serverConfig.SocketMode, "socket-mode", "0660", "permissions of Unix sockets, in octal")
 
 	serverClient = &http.Client{
 		Transport: &http.Transport{
@@ -43,20 +94,87 @@ func init() {
 	}
 }
 
-func serverFetchPublicKeys(url string) ([]ssh.PublicKey, error) {
+// A serverKeySource fetches public keys from a URL. It remembers the
+// validators of the last successful response so that unchanged keys aren't
+// downloaded and parsed again.
+type serverKeySource struct {
+	url, etag, lastModified string
+}
+
+// fetch retrieves the public keys. If the keys have not been modified since
+// the last fetch, it returns false and no keys.
+func (source *serverKeySource) fetch() ([]ssh.PublicKey, bool, error) {
+
+	request, err := http.NewRequest("GET", source.url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Send the validators from the last response, if any.
+	if source.etag != "" {
+		request.Header.Set("If-None-Match", source.etag)
+	}
+
+	if source.lastModified != "" {
+		request.Header.Set("If-Modified-Since", source.lastModified)
+	}
 
 	// Fetch the public keys.
-	response, err := serverClient.Get(url)
+	response, err := serverClient.Do(request)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+
+	// Defer the closing of the body, ignoring any error.
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		return nil, false, nil
+	case http.StatusOK:
+	default:
+		return nil, false, fmt.Errorf("server: fetching %s returned %s", source.url, response.Status)
 	}
 
 	// Read out the entire body.
 	jsonResponse, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
+	publicKeys, err := serverParsePublicKeys(jsonResponse)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Only remember the validators once the keys have been parsed, so that a
+	// bad response is fetched again.
+	source.etag = response.Header.Get("ETag")
+	source.lastModified = response.Header.Get("Last-Modified")
+
+	return publicKeys, true, nil
+}
+
+// refresh fetches the public keys at the given interval, passing them to set
+// whenever they change. Failed fetches are logged and the last good set of
+// keys is kept.
+func (source *serverKeySource) refresh(interval time.Duration, set func([]ssh.PublicKey)) {
+	for _ = range time.Tick(interval) {
+
+		publicKeys, modified, err := source.fetch()
+		if err != nil {
+			log.Printf("server: failed to refresh keys: %s\n", err)
+			continue
+		}
+
+		if modified {
+			set(publicKeys)
+		}
+	}
+}
+
+func serverParsePublicKeys(jsonResponse []byte) ([]ssh.PublicKey, error) {
+
 	// Build a raw keys object that reflects the expected structure of the JSON.
 	var rawKeys []struct {
 		Key string
@@ -86,11 +204,228 @@ func serverFetchPublicKeys(url string) ([]ssh.PublicKey, error) {
 	return publicKeys, nil
 }
 
-func serverRun(cmd *Command, args []string) {
+// A serverKeyFile loads public keys from an authorized_keys file. It
+// remembers the size and modification time of the file when it was last
+// loaded so that changes can be detected.
+type serverKeyFile struct {
+	filename string
+	modTime  time.Time
+	size     int64
+}
+
+// load reads and parses the file.
+func (file *serverKeyFile) load() ([]auth.AuthorizedKey, error) {
 
-	c, err := crypto.NewCrypterFromFile(serverConfig.SecretFilepath)
+	stat, err := os.Stat(file.filename)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(file.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizedKeys, err := auth.ParseAuthorizedKeys(data)
+	if err != nil {
+		return nil, err
+	}
+
+	file.modTime = stat.ModTime()
+	file.size = stat.Size()
+
+	return authorizedKeys, nil
+}
+
+// changed reports whether the file appears to have changed since it was last
+// loaded.
+func (file *serverKeyFile) changed() bool {
+
+	stat, err := os.Stat(file.filename)
+	if err != nil {
+		return false
+	}
+
+	return !stat.ModTime().Equal(file.modTime) || stat.Size() != file.size
+}
+
+// serverAlgorithms builds the SSH algorithms from the flags. Lists that aren't
+// set are taken from the default or FIPS profile, and in FIPS mode every
+// algorithm must belong to that profile.
+func serverAlgorithms() (*auth.Algorithms, error) {
+
+	profile := auth.DefaultAlgorithms
+	if serverConfig.FIPS {
+		profile = auth.FIPSAlgorithms
+	}
+
+	algorithms := profile
+	if serverConfig.KeyExchanges != "" {
+		algorithms.KeyExchanges = strings.Split(serverConfig.KeyExchanges, ",")
+	}
+
+	if serverConfig.Ciphers != "" {
+		algorithms.Ciphers = strings.Split(serverConfig.Ciphers, ",")
+	}
+
+	if serverConfig.MACs != "" {
+		algorithms.MACs = strings.Split(serverConfig.MACs, ",")
+	}
+
+	if serverConfig.HostKeyAlgorithms != "" {
+		algorithms.HostKeys = strings.Split(serverConfig.HostKeyAlgorithms, ",")
+	}
+
+	if serverConfig.FIPS {
+		if err := algorithms.Check(&auth.FIPSAlgorithms); err != nil {
+			return nil, err
+		}
+	}
+
+	return &algorithms, nil
+}
+
+// serverGatewayConfig builds the HTTPS gateway configuration from the flags.
+func serverGatewayConfig() (*auth.GatewayConfig, error) {
+
+	certificate, err := tls.LoadX509KeyPair(serverConfig.HTTPSCertFilepath, serverConfig.HTTPSKeyFilepath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &auth.GatewayConfig{Certificate: certificate}
+
+	if serverConfig.HTTPSClientCAFilepath != "" {
+
+		data, err := ioutil.ReadFile(serverConfig.HTTPSClientCAFilepath)
+		if err != nil {
+			return nil, err
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("server: no certificates found in %s", serverConfig.HTTPSClientCAFilepath)
+		}
+	}
+
+	if serverConfig.TokenSecretFilepath != "" {
+
+		secret, err := readSecret(serverConfig.TokenSecretFilepath)
+		if err != nil {
+			return nil, err
+		}
+
+		config.TokenSecret = secret
+	}
+
+	return config, nil
+}
+
+// serverSetKeys loads the keys in file and passes them to set, recording the
+// comment of each key as its owner's name.
+func serverSetKeys(server auth.Server, file *serverKeyFile, set func([]ssh.PublicKey)) error {
+
+	authorizedKeys, err := file.load()
+	if err != nil {
+		return err
+	}
+
+	publicKeys := make([]ssh.PublicKey, len(authorizedKeys))
+	for i, authorizedKey := range authorizedKeys {
+		publicKeys[i] = authorizedKey.Key
+	}
+
+	// Replace the names from the file, so that removed keys are forgotten.
+	server.SetIdentities(file.filename, authorizedKeys)
+	set(publicKeys)
+	return nil
+}
+
+// serverWatchKeyFiles reloads the reader, writer and administrator key files
+// whenever the process receives SIGHUP or any of the files change. Failed
+// reloads are logged and the last good set of keys is kept.
+func serverWatchKeyFiles(server auth.Server, readers, writers, admins *serverKeyFile) {
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(serverKeyFileInterval)
+
+	for {
+
+		// Reload every file on SIGHUP, or only changed files otherwise.
+		force := false
+		select {
+		case <-hangup:
+			force = true
+		case <-ticker.C:
+		}
+
+		if readers != nil && (force || readers.changed()) {
+			if err := serverSetKeys(server, readers, server.SetReadKeys); err != nil {
+				log.Printf("server: failed to reload %s: %s\n", readers.filename, err)
+			}
+		}
+
+		if writers != nil && (force || writers.changed()) {
+			if err := serverSetKeys(server, writers, server.SetWriteKeys); err != nil {
+				log.Printf("server: failed to reload %s: %s\n", writers.filename, err)
+			}
+		}
+
+		if admins != nil && (force || admins.changed()) {
+			if err := serverSetKeys(server, admins, server.SetAdminKeys); err != nil {
+				log.Printf("server: failed to reload %s: %s\n", admins.filename, err)
+			}
+		}
+	}
+}
+
+// serverShutdownOnSignal shuts down the server and closes the backend when the
+// process receives SIGTERM or SIGINT, then closes done.
+func serverShutdownOnSignal(server auth.Server, b backend.Backend, done chan struct{}) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	received := <-signals
+	log.Printf("server: received %s, shutting down\n", received)
+
+	// Stop handling signals so that a second one kills the process.
+	signal.Stop(signals)
+
+	if err := server.Shutdown(serverConfig.ShutdownTimeout); err != nil {
+		log.Println(err)
+	}
+
+	if err := b.Close(); err != nil {
+		log.Println(err)
+	}
+
+	close(done)
+}
+
+// serverCheckKeyProvider checks that the key provider flags are consistent.
+func serverCheckKeyProvider() error {
+
+	switch {
+	case serverConfig.Threshold < 0:
+		return errors.New("-threshold cannot be negative")
+	case serverConfig.Threshold > 0 && serverConfig.KeyProvider != "file":
+		return errors.New("-threshold rebuilds the master key from shares, so it can't be used with -key-provider " + serverConfig.KeyProvider)
+	case serverConfig.KeyProvider == "http" && serverConfig.KeyProviderURL == "":
+		return errors.New("-key-provider http requires -key-url")
+	case serverConfig.KeyProvider != "http" && serverConfig.KeyProviderURL != "":
+		return errors.New("-key-url is only used with -key-provider http")
+	}
+
+	return nil
+}
+
+func serverRun(cmd *Command, args []string) {
+
+	if err := serverCheckKeyProvider(); err != nil {
+		cmd.Fatal(err.Error())
 	}
 
 	b, err := backend.NewBackend(serverConfig.Backend, serverConfig.BackendNamespace, serverConfig.BackendProtocol, serverConfig.BackendAddress)
@@ -108,21 +443,160 @@ func serverRun(cmd *Command, args []string) {
 		log.Fatal("failed to parse private key")
 	}
 
-	// Create a new server using the specified Backend and Crypter.
-	server := auth.NewServer(b, c, private)
+	// Create a new server using the specified Backend. If a threshold has
+	// been set the server starts sealed; otherwise build the key provider.
+	var server auth.Server
+	if serverConfig.Threshold > 0 {
+		server = auth.NewSealedServer(b, serverConfig.Threshold, private)
+	} else {
+
+		// The file provider is located by the key path.
+		location := serverConfig.SecretFilepath
+		if serverConfig.KeyProvider != "file" {
+			location = serverConfig.KeyProviderURL
+		}
+
+		p, err := crypto.NewKeyProvider(serverConfig.KeyProvider, location)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server = auth.NewServer(b, p, private)
+	}
+
+	// Set the SSH algorithms.
+	algorithms, err := serverAlgorithms()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := server.SetAlgorithms(algorithms); err != nil {
+		log.Fatal(err)
+	}
+
+	// Set the connection and authentication limits.
+	server.SetLimits(auth.Limits{
+		MaxConnections:   serverConfig.MaxConnections,
+		HandshakeTimeout: serverConfig.HandshakeTimeout,
+		AuthAttempts:     serverConfig.AuthAttempts,
+		BanAfter:         serverConfig.BanAfter,
+		BanDuration:      serverConfig.BanDuration,
+		Window:           time.Minute,
+	})
+
+	// Check if a file of certificate authorities was provided.
+	if serverConfig.UserCAFilepath != "" {
+
+		data, err := ioutil.ReadFile(serverConfig.UserCAFilepath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		authorities, err := auth.ParseAuthorizedKeys(data)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, authority := range authorities {
+			server.AddUserAuthority(authority.Key)
+		}
+	}
+
+	// Check if a policy file was provided.
+	if serverConfig.PolicyFilepath != "" {
+
+		policy, err := auth.LoadPolicy(serverConfig.PolicyFilepath)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server.SetPolicy(policy)
+	}
+
+	// Check if an audit log was requested.
+	if serverConfig.Audit != "" {
+
+		// A chained log is keyed, so that it can't be rebuilt after a change
+		// without the key.
+		var chainKey []byte
+		if serverConfig.AuditChain {
+
+			if serverConfig.AuditKeyFilepath == "" {
+				log.Fatal("server: -audit-chain requires -audit-key")
+			}
+
+			key, err := readSecret(serverConfig.AuditKeyFilepath)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			chainKey = key
+		}
+
+		logger, err := audit.NewLogger(serverConfig.Audit, serverConfig.AuditFilepath, chainKey, serverConfig.AuditAnchor)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		server.SetAuditLogger(logger)
+	}
+
+	// Each list of keys can only come from one source.
+	if serverConfig.ReadersURL != "" && serverConfig.ReadersFilepath != "" {
+		log.Fatal("server: -r and -reader-keys-file cannot be used together")
+	}
+
+	if serverConfig.WritersURL != "" && serverConfig.WritersFilepath != "" {
+		log.Fatal("server: -w and -writer-keys-file cannot be used together")
+	}
+
+	// Check if files were provided to load keys from.
+	var readersFile, writersFile *serverKeyFile
+	if serverConfig.ReadersFilepath != "" {
+		readersFile = &serverKeyFile{filename: serverConfig.ReadersFilepath}
+		if err := serverSetKeys(server, readersFile, server.SetReadKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if serverConfig.WritersFilepath != "" {
+		writersFile = &serverKeyFile{filename: serverConfig.WritersFilepath}
+		if err := serverSetKeys(server, writersFile, server.SetWriteKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var adminsFile *serverKeyFile
+	if serverConfig.AdminsFilepath != "" {
+		adminsFile = &serverKeyFile{filename: serverConfig.AdminsFilepath}
+		if err := serverSetKeys(server, adminsFile, server.SetAdminKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if readersFile != nil || writersFile != nil || adminsFile != nil {
+		go serverWatchKeyFiles(server, readersFile, writersFile, adminsFile)
+	}
+
+	// Load the keys added and revoked by administrators.
+	if err := server.LoadManagedKeys(); err != nil {
+		log.Fatal(err)
+	}
 
 	// Check if a URL was provided to pull reader keys from.
 	if serverConfig.ReadersURL != "" {
 
 		// Fetch the reader keys.
-		readers, err := serverFetchPublicKeys(serverConfig.ReadersURL)
+		source := &serverKeySource{url: serverConfig.ReadersURL}
+		readers, _, err := source.fetch()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		// Add the reader keys to the server.
-		for _, reader := range readers {
-			server.AddReadKey(reader)
+		// Set the reader keys on the server and keep them up to date.
+		server.SetReadKeys(readers)
+		if serverConfig.RefreshInterval > 0 {
+			go source.refresh(serverConfig.RefreshInterval, server.SetReadKeys)
 		}
 	}
 
@@ -130,17 +604,80 @@ func serverRun(cmd *Command, args []string) {
 	if serverConfig.WritersURL != "" {
 
 		// Fetch the writer keys.
-		writers, err := serverFetchPublicKeys(serverConfig.WritersURL)
+		source := &serverKeySource{url: serverConfig.WritersURL}
+		writers, _, err := source.fetch()
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		// Add the writer keys to the server.
-		for _, writer := range writers {
-			server.AddWriteKey(writer)
+		// Set the writer keys on the server and keep them up to date.
+		server.SetWriteKeys(writers)
+		if serverConfig.RefreshInterval > 0 {
+			go source.refresh(serverConfig.RefreshInterval, server.SetWriteKeys)
+		}
+	}
+
+	// Shut down gracefully when signaled.
+	done := make(chan struct{})
+	go serverShutdownOnSignal(server, b, done)
+
+	// Parse the permissions for Unix sockets.
+	socketMode, err := strconv.ParseUint(serverConfig.SocketMode, 8, 32)
+	if err != nil {
+		log.Fatalf("server: invalid socket mode %q", serverConfig.SocketMode)
+	}
+
+	// Check if the HTTPS gateway was requested.
+	if serverConfig.HTTPSAddress != "" {
+
+		gatewayConfig, err := serverGatewayConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		listener, err := auth.Listen(serverConfig.HTTPSAddress, os.FileMode(socketMode))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go func() {
+			if err := server.ServeHTTPS(listener, gatewayConfig); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Use the listeners passed by systemd if the server was socket
+	// activated, and otherwise listen on the address.
+	listeners, err := auth.SystemdListeners()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(listeners) == 0 {
+
+		listener, err := auth.Listen(serverConfig.Address, os.FileMode(socketMode))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	// Serve every listener. Once they have all stopped, wait for the
+	// shutdown to finish.
+	stopped := make(chan error)
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			stopped <- server.Serve(listener)
+		}(listener)
+	}
+
+	for _ = range listeners {
+		if err := <-stopped; err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	// Start the server.
-	log.Fatal(server.ListenAndServe(serverConfig.Address))
+	<-done
 }
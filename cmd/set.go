@@ -4,8 +4,8 @@ import (
 	"code.google.com/p/gopass"
 	"fmt"
 	"github.com/buth/stocker/auth"
-	"io/ioutil"
 	"os"
+	"time"
 )
 
 var Set = &Command{
@@ -14,15 +14,26 @@ var Set = &Command{
 }
 
 var setConfig struct {
-	Address, Group, PrivateFilepath string
-	AllEnvVars                      bool
+	Address, Group, PrivateFilepath, AgentKey string
+	AllEnvVars                                bool
+	KnownHostsFilepath, HostFingerprint       string
+	TrustOnFirstUse, Randomize                bool
+	AttemptTimeout                            time.Duration
+	Retries                                   int
 }
 
 func init() {
 	Set.Run = setRun
-	Set.Flag.StringVar(&setConfig.Address, "a", ":2022", "address of the stocker server")
+	Set.Flag.StringVar(&setConfig.Address, "a", ":2022", "address of the stocker server, a comma separated list of servers to fail over between, or srv:NAME to look them up in DNS")
+	Set.Flag.BoolVar(&setConfig.Randomize, "random", false, "try the servers in a random order rather than the order given")
+	Set.Flag.DurationVar(&setConfig.AttemptTimeout, "attempt-timeout", auth.DefaultFailover.AttemptTimeout, "time allowed for each attempt to connect to a server")
+	Set.Flag.IntVar(&setConfig.Retries, "retries", auth.DefaultFailover.Retries, "number of times to retry, with backoff, once every server has failed")
 	Set.Flag.StringVar(&setConfig.Group, "g", "", "group to use for storing and retrieving data")
 	Set.Flag.StringVar(&setConfig.PrivateFilepath, "i", "", "path to an SSH private key")
+	Set.Flag.StringVar(&setConfig.AgentKey, "agent-key", "", "use the ssh-agent key with this SHA256 fingerprint or comment")
+	Set.Flag.StringVar(&setConfig.KnownHostsFilepath, "known-hosts", "", "verify the server's host key using this known_hosts file")
+	Set.Flag.StringVar(&setConfig.HostFingerprint, "host-fingerprint", "", "verify the server's host key has this SHA256 fingerprint")
+	Set.Flag.BoolVar(&setConfig.TrustOnFirstUse, "tofu", false, "trust and record the host key of servers not in the known_hosts file")
 	Set.Flag.BoolVar(&setConfig.AllEnvVars, "E", false, "use current environment when possible")
 }
 
@@ -57,31 +68,48 @@ func setRun(cmd *Command, args []string) {
 		env[variable] = value
 	}
 
-	// Read the private key from disk if a filepath has been provided.
-	var privateKey []byte
-	if setConfig.PrivateFilepath != "" {
-		privateKeyBytes, err := ioutil.ReadFile(setConfig.PrivateFilepath)
-		if err != nil {
-			cmd.Fatal(err.Error())
-		}
-		privateKey = privateKeyBytes
+	// Read the private key from disk if a filepath has been provided,
+	// prompting for its passphrase if it is encrypted.
+	key, err := clientKey(setConfig.PrivateFilepath, setConfig.AgentKey)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Build the host key callback.
+	hostKeyCallback, err := clientHostKeyCallback(setConfig.KnownHostsFilepath, setConfig.HostFingerprint, setConfig.TrustOnFirstUse)
+	if err != nil {
+		cmd.Fatal(err.Error())
 	}
 
-	// Get a new client object. If the private key is nil, the method will
-	// attempt to use ssh-agent.
-	client, err := auth.NewClient(auth.WriterUser, setConfig.Address, privateKey)
+	// Get a new client object, failing over between the servers given. If
+	// the private key is nil, the method will attempt to use ssh-agent.
+	failover := clientFailover(setConfig.Randomize, setConfig.AttemptTimeout, setConfig.Retries)
+	client, err := clientConnect(auth.WriterUser, setConfig.Address, key, hostKeyCallback, failover)
 	if err != nil {
 		cmd.Fatal(err.Error())
 	}
 
+	// Export every variable in a single request.
+	request := &auth.Request{Command: "export", Group: setConfig.Group, Variables: env}
+	if _, err := client.Do(request); err != auth.ErrSubsystemRefused {
+		if err != nil {
+			clientFatal(cmd, err)
+		}
+
+		return
+	}
+
+	// Servers that predate the subsystem need an exec command per variable.
 	for variable, value := range env {
 
 		// Create an environment specific to this variable.
-		runEnv := map[string]string{
+		variableEnv := map[string]string{
 			"GROUP":  setConfig.Group,
 			variable: value,
 		}
 
-		client.Run(fmt.Sprintf("export %s", variable), runEnv)
+		if _, err := client.Run(fmt.Sprintf("export %s", variable), variableEnv); err != nil {
+			clientFatal(cmd, err)
+		}
 	}
 }
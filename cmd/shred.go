@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"github.com/buth/stocker/auth"
+)
+
+var Shred = &Command{
+	UsageLine: "shred [options]",
+	Short:     "destroy a group's data key and values",
+}
+
+var shredConfig struct {
+	Address, Group, PrivateFilepath, AgentKey string
+	KnownHostsFilepath, HostFingerprint       string
+	TrustOnFirstUse                           bool
+}
+
+func init() {
+	Shred.Run = shredRun
+	Shred.Flag.StringVar(&shredConfig.Address, "a", ":2022", "address of the stocker server")
+	Shred.Flag.StringVar(&shredConfig.Group, "g", "", "group to destroy")
+	Shred.Flag.StringVar(&shredConfig.PrivateFilepath, "i", "", "path to an SSH private key")
+	Shred.Flag.StringVar(&shredConfig.AgentKey, "agent-key", "", "use the ssh-agent key with this SHA256 fingerprint or comment")
+	Shred.Flag.StringVar(&shredConfig.KnownHostsFilepath, "known-hosts", "", "verify the server's host key using this known_hosts file")
+	Shred.Flag.StringVar(&shredConfig.HostFingerprint, "host-fingerprint", "", "verify the server's host key has this SHA256 fingerprint")
+	Shred.Flag.BoolVar(&shredConfig.TrustOnFirstUse, "tofu", false, "trust and record the host key of servers not in the known_hosts file")
+}
+
+func shredRun(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 0 {
+		cmd.Usage(2)
+	}
+
+	// Read the private key from disk if a filepath has been provided,
+	// prompting for its passphrase if it is encrypted.
+	key, err := clientKey(shredConfig.PrivateFilepath, shredConfig.AgentKey)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Build the host key callback.
+	hostKeyCallback, err := clientHostKeyCallback(shredConfig.KnownHostsFilepath, shredConfig.HostFingerprint, shredConfig.TrustOnFirstUse)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Get a new client object. If the private key is nil, the method will
+	// attempt to use ssh-agent.
+	client, err := clientConnect(auth.WriterUser, shredConfig.Address, key, hostKeyCallback, nil)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Create an environment specific to this group.
+	runEnv := map[string]string{
+		"GROUP": shredConfig.Group,
+	}
+
+	if _, err := client.Run("shred", runEnv); err != nil {
+		clientFatal(cmd, err)
+	}
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/buth/stocker/auth"
+	"io/ioutil"
+	"time"
+)
+
+var Token = &Command{
+	UsageLine: "token [options]",
+	Short:     "create a token for the HTTPS gateway",
+	Long: `Token signs a token granting access to the HTTPS gateway of a server started
+with -token-secret, using the same secret file.`,
+}
+
+var tokenConfig struct {
+	SecretFilepath, User, Name string
+	TTL                        time.Duration
+}
+
+func init() {
+	Token.Run = tokenRun
+	Token.Flag.StringVar(&tokenConfig.SecretFilepath, "k", "/etc/stocker/token-secret", "path to the token secret")
+	Token.Flag.StringVar(&tokenConfig.User, "u", auth.ReaderUser, "user the token is for (r or w)")
+	Token.Flag.StringVar(&tokenConfig.Name, "name", "", "name of the token's holder, matched against policy principals")
+	Token.Flag.DurationVar(&tokenConfig.TTL, "ttl", 24*time.Hour, "how long the token is valid for (0 for no expiry)")
+}
+
+// readSecret reads a secret, such as a token secret or an audit log key,
+// from a file, ignoring surrounding whitespace.
+func readSecret(filename string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", filename)
+	}
+
+	return secret, nil
+}
+
+func tokenRun(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 0 {
+		cmd.Usage(2)
+	}
+
+	secret, err := readSecret(tokenConfig.SecretFilepath)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	token := &auth.Token{User: tokenConfig.User, Name: tokenConfig.Name}
+	if tokenConfig.TTL > 0 {
+		token.Expires = time.Now().Add(tokenConfig.TTL).Unix()
+	}
+
+	tokenString, err := auth.SignToken(secret, token)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	fmt.Println(tokenString)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"code.google.com/p/gopass"
+	"fmt"
+	"github.com/buth/stocker/auth"
+	"strings"
+)
+
+var Unseal = &Command{
+	UsageLine: "unseal [options]",
+	Short:     "supply a key share to a sealed server",
+}
+
+var unsealConfig struct {
+	Address, PrivateFilepath, AgentKey  string
+	KnownHostsFilepath, HostFingerprint string
+	TrustOnFirstUse                     bool
+}
+
+func init() {
+	Unseal.Run = unsealRun
+	Unseal.Flag.StringVar(&unsealConfig.Address, "a", ":2022", "address of the stocker server")
+	Unseal.Flag.StringVar(&unsealConfig.PrivateFilepath, "i", "", "path to an SSH private key")
+	Unseal.Flag.StringVar(&unsealConfig.AgentKey, "agent-key", "", "use the ssh-agent key with this SHA256 fingerprint or comment")
+	Unseal.Flag.StringVar(&unsealConfig.KnownHostsFilepath, "known-hosts", "", "verify the server's host key using this known_hosts file")
+	Unseal.Flag.StringVar(&unsealConfig.HostFingerprint, "host-fingerprint", "", "verify the server's host key has this SHA256 fingerprint")
+	Unseal.Flag.BoolVar(&unsealConfig.TrustOnFirstUse, "tofu", false, "trust and record the host key of servers not in the known_hosts file")
+}
+
+func unsealRun(cmd *Command, args []string) {
+
+	// Check the number of args.
+	if len(args) != 0 {
+		cmd.Usage(2)
+	}
+
+	// Get the share from user input.
+	share, err := gopass.GetPass("share: ")
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Read the private key from disk if a filepath has been provided,
+	// prompting for its passphrase if it is encrypted.
+	key, err := clientKey(unsealConfig.PrivateFilepath, unsealConfig.AgentKey)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Build the host key callback.
+	hostKeyCallback, err := clientHostKeyCallback(unsealConfig.KnownHostsFilepath, unsealConfig.HostFingerprint, unsealConfig.TrustOnFirstUse)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	// Get a new client object. If the private key is nil, the method will
+	// attempt to use ssh-agent.
+	client, err := clientConnect(auth.WriterUser, unsealConfig.Address, key, hostKeyCallback, nil)
+	if err != nil {
+		cmd.Fatal(err.Error())
+	}
+
+	remaining, err := client.Run(fmt.Sprintf("unseal %s", strings.TrimSpace(share)), nil)
+	if err != nil {
+		clientFatal(cmd, err)
+	}
+
+	// Report progress to the user.
+	if remaining = strings.TrimSpace(remaining); remaining == "0" {
+		fmt.Println("unsealed")
+	} else {
+		fmt.Printf("%s more shares required\n", remaining)
+	}
+}
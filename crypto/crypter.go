@@ -10,7 +10,6 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
-	"os"
 )
 
 const (
@@ -26,6 +25,14 @@ const (
 	// HmacOutputLength is the length in bytes of the sum produced by the HMAC
 	// SHA-512 algorithm.
 	HmacOutputLength = 64
+
+	// KeyLength is the combined length in bytes of the HMAC and symetric
+	// keys as they are stored on disk or split into shares.
+	KeyLength = HmacKeyLength + SymetricKeyLength
+
+	// shareCheckLength is the length in bytes of the check value split along
+	// with the keys, so that a key rebuilt from wrong shares is detected.
+	shareCheckLength = 16
 )
 
 // A Crypter is an encrypter/decrypter.
@@ -76,33 +83,58 @@ func NewRandomCrypter() (*crypter, error) {
 	return NewCrypter(rand.Reader)
 }
 
+// NewCrypterFromFile creates a crypter using the primary key in the given
+// key file. Both the PEM and legacy key file formats are supported.
 func NewCrypterFromFile(filepath string) (*crypter, error) {
 
-	// Check the status of the secret file.
-	stat, err := os.Stat(filepath)
+	entries, _, err := readKeyFile(filepath)
 	if err != nil {
 		return nil, err
 	}
 
-	// Only proceed if the running user is the only user that can read the
-	// secret.
-	if mode := stat.Mode(); mode != 0600 && mode != 0400 {
-		return nil, CrypterError{"incorrect file mode for key"}
+	return NewCrypter(bytes.NewReader(entries[0].key))
+}
+
+// NewCrypterFromShares reconstructs a crypter's keys from base 64 encoded
+// shares produced by the Split method.
+func NewCrypterFromShares(shares []string) (*crypter, error) {
+
+	// Decode each of the shares.
+	sharesBytes := make([][]byte, len(shares))
+	for i, share := range shares {
+		shareBytes, err := base64.StdEncoding.DecodeString(share)
+		if err != nil {
+			return nil, err
+		}
+		sharesBytes[i] = shareBytes
 	}
 
-	// Attempt to read the entire content of the secret file.
-	file, err := os.Open(filepath)
+	// Attempt to recombine the key.
+	key, err := Combine(sharesBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	// Defer the closing of the file, ignoring any error.
-	defer file.Close()
+	switch len(key) {
+	case KeyLength + shareCheckLength:
+
+		// The check value only matches if every share was correct.
+		if !hmac.Equal(key[KeyLength:], shareCheck(key[:KeyLength])) {
+			return nil, CrypterError{"shares do not match; at least one is wrong"}
+		}
 
-	// Create a new decoder.
-	decoder := base64.NewDecoder(base64.StdEncoding, file)
+		key = key[:KeyLength]
 
-	return NewCrypter(decoder)
+	case KeyLength:
+
+		// Shares made before check values were added can't be verified
+		// here.
+
+	default:
+		return nil, CrypterError{"shares do not contain a key"}
+	}
+
+	return NewCrypter(bytes.NewReader(key))
 }
 
 // hmac computes and returns SHA-512 Hmac sum using the signing key.
@@ -208,6 +240,11 @@ func (c *crypter) DecryptString(message string) (string, error) {
 		return "", err
 	}
 
+	// The message must at least contain a signature.
+	if len(messagebytes) < HmacOutputLength {
+		return "", CrypterError{"message is too short"}
+	}
+
 	// Check the signature.
 	if hmac.Equal(messagebytes[:64], c.hmac(messagebytes[64:])) != true {
 		return "", CrypterError{"invalid signature"}
@@ -224,36 +261,49 @@ func (c *crypter) DecryptString(message string) (string, error) {
 	return plaintext, nil
 }
 
-// ToFile saves the crypter's keys to disk, encoded as a base 64 string.
+// ToFile saves the crypter's keys to disk as a PEM encoded key file, along
+// with metadata describing them.
 func (c *crypter) ToFile(filename string) error {
+	return writeKeyFile(filename, []keyEntry{newKeyEntry(c.key())})
+}
+
+// Split divides the crypter's keys into base 64 encoded shares, any threshold
+// of which can be passed to NewCrypterFromShares to recreate the crypter. A
+// check value derived from the keys is split along with them.
+func (c *crypter) Split(shares, threshold int) ([]string, error) {
 
-	// Create a new file. This will wipe out any existing file (if we can
-	// write to it) and set permissions to 666.
-	out, err := os.Create(filename)
+	key := c.key()
+	sharesBytes, err := Split(append(key, shareCheck(key)...), shares, threshold)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Set more restrictive permissions on the file *before* we write to it.
-	if err := out.Chmod(0600); err != nil {
-		return err
+	// Encode each of the shares.
+	encoded := make([]string, len(sharesBytes))
+	for i, shareBytes := range sharesBytes {
+		encoded[i] = base64.StdEncoding.EncodeToString(shareBytes)
 	}
 
-	// Defer the closing of the file, ignoring any error.
-	defer out.Close()
-
-	// Create a new encoder.
-	encoder := base64.NewEncoder(base64.StdEncoding, out)
+	return encoded, nil
+}
 
-	if _, err := encoder.Write(c.hmacKey); err != nil {
-		return err
-	}
+// Fingerprint returns a non-secret identifier for the crypter's keys.
+func (c *crypter) Fingerprint() string {
+	return Fingerprint(c.key())
+}
 
-	if _, err := encoder.Write(c.symetricKey); err != nil {
-		return err
-	}
+// shareCheck returns the check value split along with a key.
+func shareCheck(key []byte) []byte {
+	return fingerprintSum(key)[:shareCheckLength]
+}
 
-	return encoder.Close()
+// key returns the crypter's keys as a single byte slice in the same order
+// they are written to disk.
+func (c *crypter) key() []byte {
+	key := make([]byte, KeyLength)
+	copy(key[:HmacKeyLength], c.hmacKey)
+	copy(key[HmacKeyLength:], c.symetricKey)
+	return key
 }
 
 // CrypterError represents a run-time error in a crypter method.
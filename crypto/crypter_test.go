@@ -138,3 +138,42 @@ func BenchmarkEncodeStringCold(b *testing.B) {
 		b.StopTimer()
 	}
 }
+
+func TestWrapKey(t *testing.T) {
+
+	master, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure trailing zero bytes survive the round trip.
+	key[len(key)-1] = 0
+
+	wrapped, err := WrapKey(master, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := UnwrapKey(master, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(key, unwrapped) {
+		t.Error("unwrapped key did not match!")
+	}
+
+	other, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := UnwrapKey(other, wrapped); err == nil {
+		t.Error("key unwrapped with the wrong master key")
+	}
+}
@@ -0,0 +1,58 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+)
+
+// NewDataKey returns a new random key suitable for passing to NewCrypter.
+func NewDataKey() ([]byte, error) {
+
+	key := make([]byte, KeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// WrapKey encrypts a data key using the given master crypter. The key is base
+// 64 encoded before it is encrypted so that trailing zero bytes survive
+// decryption.
+func WrapKey(master Crypter, key []byte) (string, error) {
+	return master.EncryptString(base64.StdEncoding.EncodeToString(key))
+}
+
+// UnwrapKey decrypts a data key wrapped by WrapKey.
+func UnwrapKey(master Crypter, wrapped string) ([]byte, error) {
+
+	encoded, err := master.DecryptString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != KeyLength {
+		return nil, CrypterError{"wrapped key is the wrong length"}
+	}
+
+	return key, nil
+}
+
+// NewCrypterFromWrappedKey unwraps a data key using the given key provider
+// and returns a new crypter using it.
+func NewCrypterFromWrappedKey(p KeyProvider, wrapped string) (*crypter, error) {
+
+	key, err := p.UnwrapKey(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCrypter(bytes.NewReader(key))
+}
@@ -0,0 +1,350 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+
+	// KeyBlockType is the PEM block type used for keys in a key file.
+	KeyBlockType = "STOCKER KEY"
+
+	// KeyAlgorithm identifies the algorithms a key is used with.
+	KeyAlgorithm = "AES-256-CBC+HMAC-SHA512"
+
+	// KeyPurposeMaster is the purpose recorded for keys created by the key
+	// command.
+	KeyPurposeMaster = "master"
+
+	// KeyFormatPEM and KeyFormatLegacy identify the two key file formats. The
+	// legacy format is a single bare base 64 encoded key.
+	KeyFormatPEM    = "pem"
+	KeyFormatLegacy = "legacy"
+)
+
+// fingerprintLabel is the message signed to produce a key's fingerprint.
+const fingerprintLabel = "stocker key fingerprint"
+
+// KeyInfo describes a key without exposing any secret material.
+type KeyInfo struct {
+	ID, Fingerprint, Algorithm, Purpose string
+	Created                             time.Time
+}
+
+// KeyFileInfo describes a key file and the keys it contains. The first key
+// is the primary key, used for encryption.
+type KeyFileInfo struct {
+	Format   string
+	Mode     os.FileMode
+	Modified time.Time
+	Keys     []KeyInfo
+}
+
+// keyEntry pairs a key with its metadata.
+type keyEntry struct {
+	info KeyInfo
+	key  []byte
+}
+
+// Fingerprint returns a non-secret identifier for a key in the same format
+// OpenSSH uses for public key fingerprints. The key is never hashed directly;
+// the fingerprint is an HMAC of a fixed label using the key.
+func Fingerprint(key []byte) string {
+	return "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(fingerprintSum(key)), "=")
+}
+
+// keyID returns a short identifier for a key derived from its fingerprint.
+func keyID(key []byte) string {
+	return hex.EncodeToString(fingerprintSum(key)[:8])
+}
+
+// fingerprintSum computes the HMAC SHA-256 sum of the fingerprint label.
+func fingerprintSum(key []byte) []byte {
+	signer := hmac.New(sha256.New, key)
+	signer.Write([]byte(fingerprintLabel))
+	return signer.Sum(nil)
+}
+
+// newKeyEntry returns an entry for the given key with freshly generated
+// metadata.
+func newKeyEntry(key []byte) keyEntry {
+	return keyEntry{
+		info: KeyInfo{
+			ID:          keyID(key),
+			Fingerprint: Fingerprint(key),
+			Algorithm:   KeyAlgorithm,
+			Purpose:     KeyPurposeMaster,
+			Created:     time.Now().UTC(),
+		},
+		key: key,
+	}
+}
+
+// checkKeyFileMode returns an error unless only the running user can read
+// the file.
+func checkKeyFileMode(stat os.FileInfo) error {
+	if mode := stat.Mode(); mode != 0600 && mode != 0400 {
+		return CrypterError{"incorrect file mode for key"}
+	}
+	return nil
+}
+
+// readKeyFile checks the mode of a key file and parses every key in it,
+// falling back to the legacy format if the file contains no PEM blocks.
+func readKeyFile(filepath string) ([]keyEntry, *KeyFileInfo, error) {
+
+	// Check the status of the secret file.
+	stat, err := os.Stat(filepath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Only proceed if the running user is the only user that can read the
+	// secret.
+	if err := checkKeyFileMode(stat); err != nil {
+		return nil, nil, err
+	}
+
+	info := &KeyFileInfo{
+		Mode:     stat.Mode(),
+		Modified: stat.ModTime(),
+	}
+
+	data, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []keyEntry
+	if bytes.Contains(data, []byte("-----BEGIN ")) {
+		info.Format = KeyFormatPEM
+		entries, err = parsePEMKeys(data)
+	} else {
+		info.Format = KeyFormatLegacy
+		entries, err = parseLegacyKey(data)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info.Keys = make([]KeyInfo, len(entries))
+	for i, entry := range entries {
+		info.Keys[i] = entry.info
+	}
+
+	return entries, info, nil
+}
+
+// parseLegacyKey parses a bare base 64 encoded key.
+func parseLegacyKey(data []byte) ([]keyEntry, error) {
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != KeyLength {
+		return nil, CrypterError{"incorrect key length"}
+	}
+
+	// Legacy key files don't record any metadata beyond the key itself.
+	return []keyEntry{{
+		info: KeyInfo{
+			ID:          keyID(key),
+			Fingerprint: Fingerprint(key),
+			Algorithm:   KeyAlgorithm,
+		},
+		key: key,
+	}}, nil
+}
+
+// parsePEMKeys parses one or more PEM encoded keys.
+func parsePEMKeys(data []byte) ([]keyEntry, error) {
+
+	var entries []keyEntry
+	for {
+
+		block, rest := pem.Decode(data)
+		if block == nil {
+			break
+		}
+		data = rest
+
+		if block.Type != KeyBlockType {
+			return nil, CrypterError{fmt.Sprintf("unexpected block type %q", block.Type)}
+		}
+
+		if algorithm := block.Headers["Algorithm"]; algorithm != KeyAlgorithm {
+			return nil, CrypterError{fmt.Sprintf("unsupported algorithm %q", algorithm)}
+		}
+
+		if len(block.Bytes) != KeyLength {
+			return nil, CrypterError{"incorrect key length"}
+		}
+
+		entry := keyEntry{
+			info: KeyInfo{
+				ID:          keyID(block.Bytes),
+				Fingerprint: Fingerprint(block.Bytes),
+				Algorithm:   KeyAlgorithm,
+				Purpose:     block.Headers["Purpose"],
+			},
+			key: block.Bytes,
+		}
+
+		// A recorded key ID that doesn't match indicates the key has been
+		// corrupted or tampered with.
+		if id, ok := block.Headers["Key-Id"]; ok && id != entry.info.ID {
+			return nil, CrypterError{fmt.Sprintf("key id %s does not match key", id)}
+		}
+
+		if created, ok := block.Headers["Created"]; ok {
+			createdTime, err := time.Parse(time.RFC3339, created)
+			if err != nil {
+				return nil, err
+			}
+			entry.info.Created = createdTime
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// Anything left over other than whitespace is not a valid key.
+	if len(bytes.TrimSpace(data)) != 0 {
+		return nil, CrypterError{"trailing data in key file"}
+	}
+
+	if len(entries) == 0 {
+		return nil, CrypterError{"no keys in key file"}
+	}
+
+	return entries, nil
+}
+
+// writeKeyFile writes the given keys to a new file in the PEM format,
+// replacing any existing file only once the new one has been written.
+func writeKeyFile(filename string, entries []keyEntry) error {
+
+	// Create a temporary file alongside the destination so that it can be
+	// renamed into place. Temporary files are created with mode 600.
+	out, err := ioutil.TempFile(filepath.Dir(filename), ".stocker-key")
+	if err != nil {
+		return err
+	}
+
+	// Remove the temporary file if anything goes wrong, ignoring any error.
+	defer os.Remove(out.Name())
+
+	for _, entry := range entries {
+
+		headers := map[string]string{
+			"Algorithm": entry.info.Algorithm,
+			"Key-Id":    entry.info.ID,
+		}
+
+		if entry.info.Purpose != "" {
+			headers["Purpose"] = entry.info.Purpose
+		}
+
+		if !entry.info.Created.IsZero() {
+			headers["Created"] = entry.info.Created.Format(time.RFC3339)
+		}
+
+		if err := pem.Encode(out, &pem.Block{Type: KeyBlockType, Headers: headers, Bytes: entry.key}); err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(out.Name(), filename)
+}
+
+// InspectKeyFile validates the mode, format and length of a key file and
+// describes its contents.
+func InspectKeyFile(filepath string) (*KeyFileInfo, error) {
+	_, info, err := readKeyFile(filepath)
+	return info, err
+}
+
+// AddKeyToFile creates a new random key and adds it to the front of an
+// existing key file, making it the primary key. The existing keys are kept so
+// that values encrypted with them can still be decrypted.
+func AddKeyToFile(filename string) (*KeyInfo, error) {
+
+	entries, _, err := readKeyFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := newKeyEntry(key)
+	if err := writeKeyFile(filename, append([]keyEntry{entry}, entries...)); err != nil {
+		return nil, err
+	}
+
+	return &entry.info, nil
+}
+
+// A keyring is a crypter that encrypts using its primary key and decrypts
+// using whichever of its keys produced the message's signature.
+type keyring struct {
+	crypters []*crypter
+}
+
+// NewKeyringFromFile returns a crypter using every key in the given key file.
+func NewKeyringFromFile(filepath string) (*keyring, error) {
+
+	entries, _, err := readKeyFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{crypters: make([]*crypter, len(entries))}
+	for i, entry := range entries {
+		c, err := NewCrypter(bytes.NewReader(entry.key))
+		if err != nil {
+			return nil, err
+		}
+		k.crypters[i] = c
+	}
+
+	return k, nil
+}
+
+func (k *keyring) EncryptString(plaintext string) (string, error) {
+	return k.crypters[0].EncryptString(plaintext)
+}
+
+func (k *keyring) DecryptString(message string) (string, error) {
+
+	// Try each key in turn, returning the last error if none of them work.
+	var err error
+	for _, c := range k.crypters {
+		var plaintext string
+		if plaintext, err = c.DecryptString(message); err == nil {
+			return plaintext, nil
+		}
+	}
+
+	return "", err
+}
@@ -0,0 +1,170 @@
+package crypto
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInspectKeyFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "key")
+	if err := c.ToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := InspectKeyFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Keys) != 1 {
+		t.Fatalf("expected 1 key but found %d!", len(info.Keys))
+	}
+
+	if info.Keys[0].Fingerprint != c.Fingerprint() {
+		t.Errorf("expected fingerprint %s but found %s!", c.Fingerprint(), info.Keys[0].Fingerprint)
+	}
+
+	// A readable key file should be rejected.
+	if err := os.Chmod(filename, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InspectKeyFile(filename); err == nil {
+		t.Error("key file with incorrect mode was accepted")
+	}
+
+	// A truncated key file should be rejected.
+	if err := ioutil.WriteFile(filename, []byte("c2hvcnQ="), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(filename, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := InspectKeyFile(filename); err == nil {
+		t.Error("key file with incorrect length was accepted")
+	}
+}
+
+func TestLegacyKeyFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Write the key the way older versions did.
+	filename := filepath.Join(dir, "key")
+	encoded := base64.StdEncoding.EncodeToString(c.key())
+	if err := ioutil.WriteFile(filename, []byte(encoded), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := InspectKeyFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Format != KeyFormatLegacy {
+		t.Errorf("expected format %s but found %s!", KeyFormatLegacy, info.Format)
+	}
+
+	c2, err := NewCrypterFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c2.Fingerprint() != c.Fingerprint() {
+		t.Error("legacy key file loaded the wrong key!")
+	}
+}
+
+func TestKeyringFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "stocker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "key")
+	if err := c.ToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	originaltext := "Test message !@#$%^&*()_1234567890{}[]."
+	ciphertext, err := c.EncryptString(originaltext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, err := AddKeyToFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := InspectKeyFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(info.Keys) != 2 || info.Keys[0].ID != added.ID {
+		t.Fatalf("expected the added key to be primary in %v!", info.Keys)
+	}
+
+	if info.Keys[1].Fingerprint != c.Fingerprint() || info.Keys[1].Created.IsZero() {
+		t.Errorf("original key metadata was not preserved in %v!", info.Keys[1])
+	}
+
+	k, err := NewKeyringFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keyring should still decrypt values encrypted with the old key.
+	plaintext, err := k.DecryptString(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext != originaltext {
+		t.Error("keyring decrypted the wrong text!")
+	}
+
+	// New values should be encrypted with the new primary key.
+	ciphertext, err = k.EncryptString(originaltext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.DecryptString(ciphertext); err == nil {
+		t.Error("keyring encrypted with the old key!")
+	}
+}
@@ -0,0 +1,157 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A KeyProvider wraps and unwraps data keys using a master key that it holds.
+// The master key itself never needs to leave the provider.
+type KeyProvider interface {
+	WrapKey(key []byte) (string, error)
+	UnwrapKey(wrapped string) ([]byte, error)
+}
+
+// NewKeyProvider returns a key provider of the given kind. For the "file"
+// kind, location is the path to a key file, every key of which is used; for
+// the "http" kind it is the base URL of the key service.
+func NewKeyProvider(kind, location string) (KeyProvider, error) {
+
+	// Select a provider based on kind.
+	switch kind {
+	case "file":
+		c, err := NewKeyringFromFile(location)
+		if err != nil {
+			return nil, err
+		}
+		return NewLocalKeyProvider(c), nil
+	case "http":
+		if location == "" {
+			return nil, CrypterError{"the http key provider requires a URL"}
+		}
+		return NewHTTPKeyProvider(location), nil
+	}
+
+	// Assuming no provider is implemented for kind.
+	return nil, CrypterError{fmt.Sprintf("key provider \"%s\" has not been implemented", kind)}
+}
+
+// A localKeyProvider wraps data keys using a crypter held in memory. It is
+// also a Crypter, so values encrypted directly with the master key before
+// data keys were introduced can still be read.
+type localKeyProvider struct {
+	Crypter
+}
+
+// NewLocalKeyProvider returns a key provider that wraps data keys using the
+// given crypter.
+func NewLocalKeyProvider(c Crypter) *localKeyProvider {
+	return &localKeyProvider{c}
+}
+
+func (p *localKeyProvider) WrapKey(key []byte) (string, error) {
+	return WrapKey(p.Crypter, key)
+}
+
+func (p *localKeyProvider) UnwrapKey(wrapped string) ([]byte, error) {
+	return UnwrapKey(p.Crypter, wrapped)
+}
+
+// An httpKeyProvider wraps data keys by calling an external key service. The
+// service is expected to accept POST requests to the wrap and unwrap paths
+// below the base URL:
+//
+//	POST /wrap    {"plaintext": "<base 64 key>"}  -> {"ciphertext": "..."}
+//	POST /unwrap  {"ciphertext": "..."}           -> {"plaintext": "<base 64 key>"}
+//
+// Any response status other than 200 is treated as an error.
+type httpKeyProvider struct {
+	url    string
+	client *http.Client
+}
+
+// httpKeyMessage is the body of both requests to and responses from the key
+// service.
+type httpKeyMessage struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+}
+
+// NewHTTPKeyProvider returns a key provider backed by the key service at the
+// given base URL.
+func NewHTTPKeyProvider(url string) *httpKeyProvider {
+	return &httpKeyProvider{
+		url: strings.TrimRight(url, "/"),
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}
+}
+
+// post sends a message to the given path of the key service and returns the
+// decoded response.
+func (p *httpKeyProvider) post(path string, message httpKeyMessage) (httpKeyMessage, error) {
+
+	var reply httpKeyMessage
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return reply, err
+	}
+
+	response, err := p.client.Post(p.url+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return reply, err
+	}
+
+	// Defer the closing of the body, ignoring any error.
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return reply, CrypterError{fmt.Sprintf("key service returned %s", response.Status)}
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&reply); err != nil {
+		return reply, err
+	}
+
+	return reply, nil
+}
+
+func (p *httpKeyProvider) WrapKey(key []byte) (string, error) {
+
+	reply, err := p.post("/wrap", httpKeyMessage{Plaintext: base64.StdEncoding.EncodeToString(key)})
+	if err != nil {
+		return "", err
+	}
+
+	if reply.Ciphertext == "" {
+		return "", CrypterError{"key service returned no ciphertext"}
+	}
+
+	return reply.Ciphertext, nil
+}
+
+func (p *httpKeyProvider) UnwrapKey(wrapped string) ([]byte, error) {
+
+	reply, err := p.post("/unwrap", httpKeyMessage{Ciphertext: wrapped})
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(reply.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) != KeyLength {
+		return nil, CrypterError{"unwrapped key is the wrong length"}
+	}
+
+	return key, nil
+}
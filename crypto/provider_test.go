@@ -0,0 +1,118 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestKeyService starts a stand-in key service that wraps keys with the
+// given crypter.
+func newTestKeyService(c Crypter) *httptest.Server {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/wrap", func(w http.ResponseWriter, r *http.Request) {
+		var message httpKeyMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ciphertext, err := c.EncryptString(message.Plaintext)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(httpKeyMessage{Ciphertext: ciphertext})
+	})
+
+	mux.HandleFunc("/unwrap", func(w http.ResponseWriter, r *http.Request) {
+		var message httpKeyMessage
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		plaintext, err := c.DecryptString(message.Ciphertext)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		json.NewEncoder(w).Encode(httpKeyMessage{Plaintext: plaintext})
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestKeyProviders(t *testing.T) {
+
+	c, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := newTestKeyService(c)
+	defer service.Close()
+
+	providers := map[string]KeyProvider{
+		"local": NewLocalKeyProvider(c),
+		"http":  NewHTTPKeyProvider(service.URL + "/"),
+	}
+
+	for name, p := range providers {
+
+		key, err := NewDataKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wrapped, err := p.WrapKey(key)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		unwrapped, err := p.UnwrapKey(wrapped)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if !bytes.Equal(key, unwrapped) {
+			t.Errorf("%s: unwrapped key did not match!", name)
+		}
+	}
+}
+
+func TestHTTPKeyProviderError(t *testing.T) {
+
+	c, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := newTestKeyService(c)
+	defer service.Close()
+
+	p := NewHTTPKeyProvider(service.URL)
+
+	if _, err := p.UnwrapKey(base64.StdEncoding.EncodeToString(make([]byte, 128))); err == nil {
+		t.Error("invalid ciphertext was unwrapped")
+	}
+}
+
+func TestNewKeyProviderUnknown(t *testing.T) {
+	if _, err := NewKeyProvider("unknown", ""); err == nil {
+		t.Error("unknown key provider was created")
+	}
+
+	if _, err := NewKeyProvider("http", ""); err == nil {
+		t.Error("http key provider was created without a URL")
+	}
+}
@@ -0,0 +1,160 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// gfExp and gfLog are lookup tables for multiplication and division in GF(2^8)
+// using the AES reducing polynomial (x^8 + x^4 + x^3 + x + 1) and the
+// generator 3.
+var gfExp [510]byte
+var gfLog [256]byte
+
+func init() {
+
+	// Walk the powers of the generator, recording each power and its
+	// logarithm. The gfExp table is doubled in length so that the sum of two
+	// logarithms never needs to be reduced.
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+
+		// Multiply x by the generator (x + 1) and reduce.
+		high := x & 0x80
+		x2 := x << 1
+		if high != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+}
+
+// gfMul multiplies two elements of GF(2^8).
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfDiv divides a by b in GF(2^8). The caller is responsible for ensuring
+// that b is not zero.
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// Split divides secret into the given number of shares using Shamir's secret
+// sharing scheme, such that any threshold of the shares are sufficient to
+// reconstruct it. Each share is one byte longer than the secret; the first
+// byte is the share's x-coordinate.
+func Split(secret []byte, shares, threshold int) ([][]byte, error) {
+
+	// Check that the parameters make sense. The x-coordinate is stored in a
+	// single byte and may not be zero.
+	if threshold < 2 {
+		return nil, CrypterError{"threshold must be at least 2"}
+	}
+
+	if shares < threshold {
+		return nil, CrypterError{"shares must not be less than threshold"}
+	}
+
+	if shares > 255 {
+		return nil, CrypterError{"shares must not be greater than 255"}
+	}
+
+	if len(secret) == 0 {
+		return nil, CrypterError{"secret is empty"}
+	}
+
+	// Initialize each share with its x-coordinate.
+	output := make([][]byte, shares)
+	for i := range output {
+		output[i] = make([]byte, len(secret)+1)
+		output[i][0] = byte(i + 1)
+	}
+
+	// Each byte of the secret is the constant term of a separate random
+	// polynomial of degree threshold - 1.
+	coefficients := make([]byte, threshold)
+	for j, secretByte := range secret {
+
+		coefficients[0] = secretByte
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		// Evaluate the polynomial at each share's x-coordinate using
+		// Horner's method.
+		for i := range output {
+			x := output[i][0]
+			y := byte(0)
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[k]
+			}
+			output[i][j+1] = y
+		}
+	}
+
+	return output, nil
+}
+
+// Combine reconstructs a secret from shares produced by Split. At least as
+// many shares as the original threshold must be provided; Combine has no way
+// of detecting when too few shares have been given and will return an
+// incorrect secret.
+func Combine(shares [][]byte) ([]byte, error) {
+
+	if len(shares) < 2 {
+		return nil, CrypterError{"at least two shares are required"}
+	}
+
+	// Every share must be the same length and have a distinct, non-zero
+	// x-coordinate.
+	length := len(shares[0])
+	if length < 2 {
+		return nil, CrypterError{"share is too short"}
+	}
+
+	seen := make(map[byte]bool)
+	for _, share := range shares {
+		if len(share) != length {
+			return nil, CrypterError{"shares are not the same length"}
+		}
+
+		if share[0] == 0 || seen[share[0]] {
+			return nil, CrypterError{"invalid share"}
+		}
+		seen[share[0]] = true
+	}
+
+	// Use Lagrange interpolation to find the value of each polynomial at
+	// zero.
+	secret := make([]byte, length-1)
+	for j := range secret {
+
+		var value byte
+		for i, si := range shares {
+
+			// Compute the Lagrange basis polynomial for share i at zero.
+			basis := byte(1)
+			for k, sk := range shares {
+				if k != i {
+					basis = gfMul(basis, gfDiv(sk[0], sk[0]^si[0]))
+				}
+			}
+
+			value ^= gfMul(si[j+1], basis)
+		}
+
+		secret[j] = value
+	}
+
+	return secret, nil
+}
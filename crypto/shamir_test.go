@@ -0,0 +1,147 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+
+	secret := make([]byte, KeyLength)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(shares) != 5 {
+		t.Fatalf("expected 5 shares but found %d!", len(shares))
+	}
+
+	// Any three shares should be enough to recover the secret.
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}} {
+
+		selected := make([][]byte, len(subset))
+		for i, j := range subset {
+			selected[i] = shares[j]
+		}
+
+		combined, err := Combine(selected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(combined, secret) {
+			t.Errorf("shares %v did not recover the secret!", subset)
+		}
+	}
+
+	// Two shares should not be.
+	combined, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(combined, secret) {
+		t.Error("two shares recovered the secret!")
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+
+	if _, err := Split([]byte("secret"), 2, 3); err == nil {
+		t.Error("split allowed fewer shares than the threshold")
+	}
+
+	if _, err := Split([]byte("secret"), 3, 1); err == nil {
+		t.Error("split allowed a threshold of one")
+	}
+
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Combine([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("combine allowed a repeated share")
+	}
+}
+
+func TestCrypterShares(t *testing.T) {
+
+	c, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := c.Split(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c2, err := NewCrypterFromShares(shares[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originaltext := "Test message !@#$%^&*()_1234567890{}[]."
+
+	ciphertext, err := c.EncryptString(originaltext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext, err := c2.DecryptString(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plaintext != originaltext {
+		t.Error("crypter recovered from shares could not decrypt!")
+	}
+}
+
+func TestCrypterSharesWrong(t *testing.T) {
+
+	c, err := NewRandomCrypter()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := c.Split(3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt a byte of the key in one of the shares.
+	shareBytes, err := base64.StdEncoding.DecodeString(shares[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shareBytes[10] ^= 0xff
+	shares[0] = base64.StdEncoding.EncodeToString(shareBytes)
+
+	if _, err := NewCrypterFromShares(shares[:2]); err == nil {
+		t.Error("rebuilt a key from a corrupted share")
+	}
+
+	// A legacy share, made without a check value, is still accepted.
+	legacy, err := Split(c.key(), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := []string{base64.StdEncoding.EncodeToString(legacy[0]), base64.StdEncoding.EncodeToString(legacy[1])}
+	if c2, err := NewCrypterFromShares(encoded); err != nil {
+		t.Error(err)
+	} else if c2.Fingerprint() != c.Fingerprint() {
+		t.Error("rebuilt the wrong key from legacy shares")
+	}
+}
@@ -12,6 +12,13 @@ var commands = []*cmd.Command{
 	cmd.Set,
 	cmd.Exec,
 	cmd.Server,
+	cmd.Unseal,
+	cmd.Rewrap,
+	cmd.Shred,
+	cmd.Keys,
+	cmd.Audit,
+	cmd.Token,
+	cmd.Agent,
 }
 
 func Usage(code int) {